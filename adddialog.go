@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// addRequest is a torrent for the add dialog.
+// Either a torrent file that is not yet added, or a magnet that was added paused and has received its info.
+type addRequest struct {
+	spec     *torrent.TorrentSpec // of torrent file
+	webSeeds []string             // of torrent file
+	info     *metainfo.Info
+	t        *torrent.Torrent // of magnet
+}
+
+var (
+	pendingAdds = map[metainfo.Hash]bool{} // magnets without info yet, the add dialog is shown when it arrives
+	addQueue    []addRequest               // shown one by one, while the main view is shown
+)
+
+// addTorrentFile adds the torrent file at path, through the add dialog unless disabled.
+func addTorrentFile(path string) {
+	mi, err := metainfo.LoadFromFile(path)
+	var info metainfo.Info
+	if err == nil {
+		info, err = mi.UnmarshalInfo()
+	}
+	if err != nil {
+		logErrorf(nil, "adding torrent file: %s", err)
+		runHook("error", nil, fmt.Errorf("adding torrent file: %s", err))
+		return
+	}
+	spec := torrent.TorrentSpecFromMetaInfo(mi)
+	if row := findRowHash(spec.InfoHash); row != nil {
+		selectTorrent(row.Value.(*torrent.Torrent))
+		return
+	}
+	if settings.NoAddDialog {
+		t, err := addTorrent(spec, addOpts{WebSeeds: mi.UrlList})
+		if err != nil {
+			logErrorf(nil, "adding torrent file: %s", err)
+			runHook("error", nil, fmt.Errorf("adding torrent file: %s", err))
+			return
+		}
+		selectTorrent(t)
+		return
+	}
+	addQueue = append(addQueue, addRequest{spec: spec, webSeeds: mi.UrlList, info: &info})
+	showAdds()
+}
+
+// gotAddInfo queues the add dialog for t if it was waiting for its info.
+func gotAddInfo(t *torrent.Torrent) {
+	h := t.InfoHash()
+	if !pendingAdds[h] {
+		return
+	}
+	delete(pendingAdds, h)
+	addQueue = append(addQueue, addRequest{info: t.Info(), t: t})
+	showAdds()
+}
+
+// showAdds shows the add dialog for the next queued torrent, if the main view is shown.
+func showAdds() {
+	for mainShown && len(addQueue) > 0 {
+		r := addQueue[0]
+		addQueue = addQueue[1:]
+		if r.t != nil && findRow(r.t) == nil {
+			// removed in the mean time
+			continue
+		}
+		showView(addView(r))
+	}
+}
+
+// existingDir returns dir or its first parent that exists, for finding its file system.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			return dir
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// addView returns the add dialog, for choosing files, directory, label, whether to start and position in the list.
+func addView(r addRequest) duit.UI {
+	info := r.info
+	var h metainfo.Hash
+	if r.t != nil {
+		h = r.t.InfoHash()
+	} else {
+		h = r.spec.InfoHash
+	}
+
+	// file tree, directories first
+	type file struct {
+		index int
+		path  []string
+		size  int64
+		check *duit.Checkbox
+	}
+	var files []*file
+	for i, fi := range info.UpvertedFiles() {
+		p := []string{info.Name}
+		if len(info.Files) > 0 {
+			p = append(p, fi.Path...)
+		}
+		files = append(files, &file{i, p, fi.Length, &duit.Checkbox{Checked: r.t == nil || fileWanted(h, i)}})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i].path, files[j].path
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				adir, bdir := k < len(a)-1, k < len(b)-1
+				if adir != bdir {
+					return adir
+				}
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	type dir struct {
+		files []*file
+		check *duit.Checkbox
+	}
+	var dirs []*dir
+	var total int64
+	selected := &duit.Label{}
+	var update func()
+	var treeKids []duit.UI
+	var open []string // directories of previous file
+	var openDirs []*dir
+	for _, f := range files {
+		total += f.size
+		parents := f.path[:len(f.path)-1]
+		n := 0
+		for n < len(open) && n < len(parents) && open[n] == parents[n] {
+			n++
+		}
+		open = open[:n]
+		openDirs = openDirs[:n]
+		for _, name := range parents[n:] {
+			d := &dir{check: &duit.Checkbox{}}
+			d.check.Changed = func() (e duit.Event) {
+				for _, f := range d.files {
+					f.check.Checked = d.check.Checked
+				}
+				update()
+				return
+			}
+			dirs = append(dirs, d)
+			treeKids = append(treeKids, d.check, &duit.Label{Text: strings.Repeat("    ", len(open)) + name + "/"}, &duit.Label{})
+			open = append(open, name)
+			openDirs = append(openDirs, d)
+		}
+		for _, d := range openDirs {
+			d.files = append(d.files, f)
+		}
+		f.check.Changed = func() (e duit.Event) {
+			update()
+			return
+		}
+		treeKids = append(treeKids, f.check, &duit.Label{Text: strings.Repeat("    ", len(open)) + f.path[len(f.path)-1]}, &duit.Label{Text: formatSize(f.size)})
+	}
+	// sizes of directories
+	di := 0
+	for i := 0; i < len(treeKids); i += 3 {
+		if di < len(dirs) && treeKids[i] == dirs[di].check {
+			var size int64
+			for _, f := range dirs[di].files {
+				size += f.size
+			}
+			treeKids[i+2].(*duit.Label).Text = formatSize(size)
+			di++
+		}
+	}
+	tree := &duit.Grid{
+		Columns: 3,
+		Padding: []duit.Space{
+			{Top: 1, Right: 4, Bottom: 1, Left: 0},
+			{Top: 1, Right: 4, Bottom: 1, Left: 4},
+			{Top: 1, Right: 0, Bottom: 1, Left: 4},
+		},
+		Halign: []duit.Halign{duit.HalignLeft, duit.HalignLeft, duit.HalignRight},
+		Kids:   duit.NewKids(treeKids...),
+	}
+
+	dirText := defaultDataDir()
+	if r.t != nil && torrentDir[h] != "" {
+		dirText = torrentDir[h]
+	}
+	dirField := &duit.Field{Text: dirText}
+	dirEdited := false
+	free := &duit.Label{}
+	updateFree := func() {
+		n, err := freeSpace(existingDir(dirField.Text))
+		if err != nil {
+			free.Text = "free space unknown: " + err.Error()
+		} else {
+			free.Text = "free: " + formatSize(n)
+		}
+		dui.MarkLayout(nil)
+	}
+	dirField.Changed = func(string) (e duit.Event) {
+		dirEdited = true
+		updateFree()
+		return
+	}
+	label := ""
+	if r.t != nil {
+		label = torrentLabel[h]
+	}
+	labelField := &duit.Field{Text: label}
+	labelField.Changed = func(text string) (e duit.Event) {
+		// directory follows the label, until changed by hand
+		if d := settings.Labels[text].Dir; !dirEdited {
+			if d == "" {
+				d = defaultDataDir()
+			}
+			dirField.Text = d
+			updateFree()
+		}
+		return
+	}
+	start := &duit.Buttongroup{Texts: []string{"start now", "paused"}}
+	positionField := &duit.Field{Text: "1"}
+	noAsk := &duit.Checkbox{}
+	status := &duit.Label{}
+
+	update = func() {
+		for _, d := range dirs {
+			d.check.Checked = true
+			for _, f := range d.files {
+				d.check.Checked = d.check.Checked && f.check.Checked
+			}
+		}
+		var size int64
+		for _, f := range files {
+			if f.check.Checked {
+				size += f.size
+			}
+		}
+		selected.Text = fmt.Sprintf("selected %s of %s", formatSize(size), formatSize(total))
+		dui.MarkLayout(nil)
+	}
+	update()
+	updateFree()
+
+	setAll := func(v bool) func() (e duit.Event) {
+		return func() (e duit.Event) {
+			for _, f := range files {
+				f.check.Checked = v
+			}
+			update()
+			return
+		}
+	}
+
+	add := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		pos, err := strconv.Atoi(positionField.Text)
+		if err != nil || pos < 1 {
+			status.Text = "bad list position"
+			return
+		}
+		sel := make([]bool, len(files))
+		any := false
+		for _, f := range files {
+			sel[f.index] = f.check.Checked
+			any = any || f.check.Checked
+		}
+		if !any {
+			status.Text = "no files selected"
+			return
+		}
+		if noAsk.Checked {
+			settings.NoAddDialog = true
+			saveSettings()
+		}
+		dir := dirField.Text
+		if dir == defaultDataDir() {
+			dir = ""
+		}
+		label := labelField.Text
+		want := start.Selected == 0
+
+		t := r.t
+		if t == nil {
+			t, err = addTorrent(r.spec, addOpts{Dir: dir, Label: label, Paused: true, WebSeeds: r.webSeeds})
+			if err != nil {
+				status.Text = fmt.Sprintf("adding torrent: %s", err)
+				return
+			}
+		} else {
+			row := findRow(t)
+			if row == nil {
+				showMain()
+				return
+			}
+			if label != torrentLabel[h] {
+				if label == "" {
+					delete(torrentLabel, h)
+				} else {
+					torrentLabel[h] = label
+					labelDefaults(h, label)
+					applyLimits(t)
+				}
+			}
+			if dir != torrentDir[h] {
+				// nothing has been downloaded yet, we can just add it again with the new directory
+				mi := t.Metainfo()
+				spec := &torrent.TorrentSpec{
+					InfoHash:    h,
+					Trackers:    mi.AnnounceList,
+					InfoBytes:   mi.InfoBytes,
+					DisplayName: t.Name(),
+				}
+				accountTransfer(t)
+				t.Drop()
+				if dir == "" {
+					delete(torrentDir, h)
+				} else {
+					torrentDir[h] = dir
+				}
+				if err := readdTorrent(row, spec); err != nil {
+					logErrorf(t, "adding with new directory: %s", err)
+				}
+				t = row.Value.(*torrent.Torrent)
+			}
+		}
+		setFileSelection(t, sel)
+		setWant(t, want)
+		moveRow(findRow(t), pos-1)
+		saveSession()
+		showMain()
+		selectTorrent(t)
+		showAdds()
+		return
+	}
+	cancel := func() (e duit.Event) {
+		if r.t != nil {
+			removeTorrent(r.t, false)
+		}
+		showMain()
+		showAdds()
+		return
+	}
+	nextViewClose = func() { cancel() }
+
+	field := func(width int, f *duit.Field) duit.UI {
+		return &duit.Box{Width: width, Kids: duit.NewKids(f)}
+	}
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(0, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: "Add " + info.Name, Font: bold},
+			&duit.Grid{
+				Columns: 2,
+				Padding: []duit.Space{
+					{Top: 2, Right: 4, Bottom: 2, Left: 0},
+					{Top: 2, Right: 0, Bottom: 2, Left: 4},
+				},
+				Kids: duit.NewKids(
+					&duit.Label{Text: "Directory"}, &duit.Box{Margin: image.Pt(6, 0), Kids: duit.NewKids(field(400, dirField), free)},
+					&duit.Label{Text: "Label"}, field(200, labelField),
+					&duit.Label{Text: "Start"}, start,
+					&duit.Label{Text: "Position in list"}, field(80, positionField),
+				),
+			},
+			&duit.Box{
+				Margin: image.Pt(6, 0),
+				Kids: duit.NewKids(
+					&duit.Button{Text: "all", Click: setAll(true)},
+					&duit.Button{Text: "none", Click: setAll(false)},
+					selected,
+				),
+			},
+			&duit.Scroll{
+				Height: -1,
+				Kid:    duit.Kid{UI: &duit.Box{Padding: duit.SpaceXY(0, 4), Kids: duit.NewKids(tree)}},
+			},
+			&duit.Box{
+				Margin: image.Pt(6, 0),
+				Valign: duit.ValignMiddle,
+				Kids: duit.NewKids(
+					&duit.Button{
+						Text:     "add",
+						Colorset: &dui.Primary,
+						Click:    add,
+					},
+					&duit.Button{
+						Text:  "don't add",
+						Click: cancel,
+					},
+					noAsk,
+					&duit.Label{Text: "always use defaults, don't ask"},
+					status,
+				),
+			},
+		),
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// badPeer is a peer IP that was blamed for pieces that failed the hash check.
+// The torrent library blames one peer per failed piece, drops it and refuses its IP for the lifetime of the client.
+// So we see at most one failure per IP per client. We count them across restarts, and ban the IP permanently at Settings.BanThreshold.
+type badPeer struct {
+	Failures int    // pieces blamed on the peer
+	Bytes    int64  // size of the pieces blamed on the peer, for failures in a known torrent
+	Torrent  string // of the last failure, if known
+	Last     time.Time
+}
+
+var (
+	badPeers       map[string]*badPeer // by IP
+	badPeersPath   string
+	badPeersClient *torrent.Client         // for which badPeersSeen and piecesBad are kept
+	badPeersSeen   map[string]bool         // IPs banned by badPeersClient that have been counted
+	piecesBad      map[metainfo.Hash]int64 // PiecesDirtiedBad as of the previous check
+)
+
+func loadBadPeers() {
+	badPeersPath = appDataDir() + "/badpeers.json"
+	badPeers = map[string]*badPeer{}
+	buf, err := ioutil.ReadFile(badPeersPath)
+	if err == nil {
+		err = json.Unmarshal(buf, &badPeers)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf(nil, "reading bad peers: %s", err)
+	}
+}
+
+func saveBadPeers() {
+	buf, err := json.Marshal(badPeers)
+	if err == nil {
+		os.MkdirAll(appDataDir(), 0777)
+		err = ioutil.WriteFile(badPeersPath, buf, 0666)
+	}
+	if err != nil {
+		logErrorf(nil, "saving bad peers: %s", err)
+	}
+}
+
+func banThreshold() int {
+	if settings.BanThreshold == 0 {
+		return 1
+	}
+	return settings.BanThreshold
+}
+
+func banned(ip string) bool {
+	for _, b := range settings.BannedIPs {
+		if b == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBadPeers counts the peers the client banned since the previous check.
+// They are attributed to the torrent that had pieces fail in the meantime, if only one did.
+func checkBadPeers() {
+	if badPeersClient != client {
+		badPeersClient = client
+		badPeersSeen = map[string]bool{}
+		piecesBad = map[metainfo.Hash]int64{}
+	}
+
+	var bt *torrent.Torrent // torrent with failures, if only one
+	n := 0
+	for _, t := range clientTorrents() {
+		h := t.InfoHash()
+		st := t.Stats()
+		bad := st.PiecesDirtiedBad.Int64()
+		if bad > piecesBad[h] {
+			bt = t
+			n++
+		}
+		piecesBad[h] = bad
+	}
+	name := ""
+	if n > 1 {
+		bt = nil
+	} else if bt != nil {
+		name = bt.Name()
+	}
+
+	var ips []string
+	for _, ip := range badPeerIPs() {
+		if !badPeersSeen[ip] {
+			badPeersSeen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return
+	}
+	for _, ip := range ips {
+		p := badPeers[ip]
+		if p == nil {
+			p = &badPeer{}
+			badPeers[ip] = p
+		}
+		p.Failures++
+		if bt != nil && bt.Info() != nil {
+			// the library doesn't tell which piece failed, all but the last have the piece length
+			p.Bytes += bt.Info().PieceLength
+		}
+		p.Torrent = name
+		p.Last = time.Now()
+		logWarnf(bt, "peer %s blamed for a piece that failed its hash check, %d times so far", ip, p.Failures)
+		if threshold := banThreshold(); threshold > 0 && p.Failures >= threshold && !banned(ip) {
+			logInfof(nil, "banning peer %s", ip)
+			if err := banIP(ip); err != nil {
+				logErrorf(nil, "banning peer %s: %s", ip, err)
+			}
+		}
+	}
+	saveBadPeers()
+}
+
+// badPeersView returns the UI listing peers that sent bad data, and the bad data per torrent.
+func badPeersView() duit.UI {
+	torrentsBox := &duit.Box{Width: -1}
+	peersBox := &duit.Box{Width: -1}
+
+	makeGrid := func(columns int, kids ...duit.UI) *duit.Grid {
+		padding := make([]duit.Space, columns)
+		for i := range padding {
+			padding[i] = duit.Space{Top: 2, Right: 4, Bottom: 2, Left: 4}
+		}
+		return &duit.Grid{
+			Columns: columns,
+			Padding: padding,
+			Width:   -1,
+			Kids:    duit.NewKids(kids...),
+		}
+	}
+	label := func(s string) duit.UI {
+		return &duit.Label{Text: s}
+	}
+
+	var update func()
+	update = func() {
+		kids := []duit.UI{label("torrent"), label("bad pieces"), label("wasted chunks")}
+		for _, t := range clientTorrents() {
+			st := t.Stats()
+			bad, wasted := st.PiecesDirtiedBad.Int64(), st.ChunksReadWasted.Int64()
+			if bad == 0 && wasted == 0 {
+				continue
+			}
+			kids = append(kids, label(t.Name()), label(fmt.Sprintf("%d", bad)), label(fmt.Sprintf("%d", wasted)))
+		}
+		torrentsBox.Kids = duit.NewKids(makeGrid(3, kids...))
+
+		session := map[string]bool{}
+		for _, ip := range badPeerIPs() {
+			session[ip] = true
+		}
+		ips := map[string]bool{}
+		for ip := range badPeers {
+			ips[ip] = true
+		}
+		for ip := range session {
+			ips[ip] = true
+		}
+		var l []string
+		for ip := range ips {
+			l = append(l, ip)
+		}
+		sort.Strings(l)
+
+		kids = []duit.UI{label("ip"), label("pieces blamed"), label("bad data"), label("last"), label("torrent"), label("status"), label("")}
+		for _, ip := range l {
+			ip := ip
+			p := badPeers[ip]
+			if p == nil {
+				p = &badPeer{}
+			}
+			last := ""
+			if !p.Last.IsZero() {
+				last = p.Last.Format("2006-01-02 15:04")
+			}
+			status := ""
+			if session[ip] {
+				status = "refused until restart"
+			}
+			button := &duit.Button{
+				Text: "ban",
+				Click: func() (e duit.Event) {
+					if err := banIP(ip); err != nil {
+						logErrorf(nil, "banning peer %s: %s", ip, err)
+					}
+					update()
+					return
+				},
+			}
+			if banned(ip) {
+				status = "banned"
+				button = &duit.Button{
+					Text: "unban",
+					Click: func() (e duit.Event) {
+						unbanIP(ip)
+						if p := badPeers[ip]; p != nil {
+							p.Failures = 0
+							p.Bytes = 0
+							saveBadPeers()
+						}
+						update()
+						return
+					},
+				}
+			}
+			kids = append(kids, label(ip), label(fmt.Sprintf("%d", p.Failures)), label(formatSize(p.Bytes)), label(last), label(p.Torrent), label(status), button)
+		}
+		peersBox.Kids = duit.NewKids(makeGrid(7, kids...))
+		dui.MarkLayout(nil)
+	}
+	update()
+	nextViewTick = update
+
+	threshold := "disabled"
+	if t := banThreshold(); t > 0 {
+		threshold = fmt.Sprintf("after %d blamed pieces", t)
+	}
+	title := func(s string) duit.UI {
+		return &duit.Box{Padding: duit.Space{Top: 10}, Width: -1, Kids: duit.NewKids(&duit.Label{Text: s, Font: bold})}
+	}
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Bad peers", Font: bold},
+				&duit.Label{Text: "automatic ban: " + threshold},
+				title("Torrents"),
+				torrentsBox,
+				title("Peers"),
+				peersBox,
+				&duit.Box{
+					Padding: duit.Space{Top: 10},
+					Kids: duit.NewKids(
+						&duit.Button{
+							Text: "close",
+							Click: func() (e duit.Event) {
+								showMain()
+								return
+							},
+						},
+					),
+				},
+			),
+		}},
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent/iplist"
+	"github.com/mjl-/duit"
+)
+
+// blocklist is the IP blocklist of the client.
+// The client only takes a blocklist when it is created, so we give it this one and swap its ranges when reloading.
+type blocklist struct {
+	sync.Mutex
+	v4, v6  *iplist.IPList
+	refused int64 // lookups that matched, atomic
+}
+
+var ipBlocklist = &blocklist{v4: iplist.New(nil), v6: iplist.New(nil)}
+
+// Lookup is called by the client for incoming and outgoing connections.
+func (b *blocklist) Lookup(ip net.IP) (r iplist.Range, ok bool) {
+	b.Lock()
+	v4, v6 := b.v4, b.v6
+	b.Unlock()
+	if ip4 := ip.To4(); ip4 != nil {
+		r, ok = v4.Lookup(ip4)
+	} else {
+		r, ok = v6.Lookup(ip)
+	}
+	if ok {
+		atomic.AddInt64(&b.refused, 1)
+	}
+	return
+}
+
+func (b *blocklist) NumRanges() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.v4.NumRanges() + b.v6.NumRanges()
+}
+
+// set replaces the ranges, which can overlap and be unsorted.
+func (b *blocklist) set(ranges []iplist.Range) {
+	var l4, l6 []iplist.Range
+	for _, r := range ranges {
+		if len(r.First) == net.IPv4len {
+			l4 = append(l4, r)
+		} else {
+			l6 = append(l6, r)
+		}
+	}
+	v4, v6 := iplist.New(mergeRanges(l4)), iplist.New(mergeRanges(l6))
+	b.Lock()
+	b.v4, b.v6 = v4, v6
+	b.Unlock()
+}
+
+// mergeRanges sorts ranges and merges overlapping ranges, as required by iplist.
+func mergeRanges(l []iplist.Range) []iplist.Range {
+	sort.Slice(l, func(i, j int) bool {
+		return bytes.Compare(l[i].First, l[j].First) < 0
+	})
+	var r []iplist.Range
+	for _, x := range l {
+		if n := len(r); n > 0 && bytes.Compare(x.First, r[n-1].Last) <= 0 {
+			if bytes.Compare(x.Last, r[n-1].Last) > 0 {
+				r[n-1].Last = x.Last
+			}
+			continue
+		}
+		r = append(r, x)
+	}
+	return r
+}
+
+// normalizeIP returns 4-byte IPv4 addresses, as iplist expects.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// parseIPLoose parses an IP, also IPv4 with leading zeros as found in ipfilter.dat files.
+func parseIPLoose(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return normalizeIP(ip)
+	}
+	t := strings.Split(s, ".")
+	if len(t) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, x := range t {
+		v, err := strconv.ParseUint(x, 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(v)
+	}
+	return ip
+}
+
+// parseBan parses an IP, CIDR range or "first-last" range.
+func parseBan(s string) (iplist.Range, error) {
+	s = strings.TrimSpace(s)
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		ipnet.IP = normalizeIP(ipnet.IP)
+		if len(ipnet.IP) == net.IPv4len {
+			ipnet.Mask = ipnet.Mask[len(ipnet.Mask)-net.IPv4len:]
+		}
+		return iplist.Range{First: ipnet.IP, Last: iplist.IPNetLast(ipnet), Description: "banned"}, nil
+	}
+	t := strings.SplitN(s, "-", 2)
+	first := parseIPLoose(t[0])
+	last := first
+	if len(t) == 2 {
+		last = parseIPLoose(t[1])
+	}
+	if first == nil || last == nil || len(first) != len(last) || bytes.Compare(first, last) > 0 {
+		return iplist.Range{}, fmt.Errorf("bad IP or range %q", s)
+	}
+	return iplist.Range{First: first, Last: last, Description: "banned"}, nil
+}
+
+// ipfilterLine matches a line in eMule ipfilter.dat format, with first, last, level and optional description.
+// Lines that don't match are in P2P format, whose description can contain commas.
+var ipfilterLine = regexp.MustCompile(`^([0-9a-fA-F.:]+)\s*-\s*([0-9a-fA-F.:]+)\s*,\s*(\d+)\s*(?:,(.*))?$`)
+
+// parseBlocklist reads a blocklist in P2P plaintext format ("description:first-last")
+// or eMule ipfilter.dat format ("first - last , level , description"), detected per line.
+// In ipfilter.dat, ranges with level above 127 are not blocked.
+func parseBlocklist(r io.Reader) ([]iplist.Range, error) {
+	var l []iplist.Range
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if m := ipfilterLine.FindStringSubmatch(line); m != nil {
+			level, err := strconv.Atoi(m[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad access level: %s", lineno, err)
+			}
+			if level > 127 {
+				continue
+			}
+			r := iplist.Range{First: parseIPLoose(m[1]), Last: parseIPLoose(m[2]), Description: strings.TrimSpace(m[4])}
+			if r.First == nil || r.Last == nil || len(r.First) != len(r.Last) {
+				return nil, fmt.Errorf("line %d: bad IP range", lineno)
+			}
+			l = append(l, r)
+			continue
+		}
+		r, ok, err := iplist.ParseBlocklistP2PLine([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		if ok {
+			l = append(l, r)
+		}
+	}
+	return l, scanner.Err()
+}
+
+// blocklistSource is a blocklist file or URL from the settings.
+type blocklistSource struct {
+	Source  string
+	Ranges  int
+	Loaded  time.Time
+	ModTime time.Time // for files, to detect changes
+	Err     error
+
+	ranges []iplist.Range
+}
+
+var (
+	blocklistStatus []blocklistSource        // copy for the UI, updated from blocklistLoop
+	blocklistBans   = make(chan []string, 1) // latest banned IPs, see sendBans
+	blocklistReload = make(chan struct{})
+)
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func loadBlocklist(src string) ([]iplist.Range, error) {
+	var r io.ReadCloser
+	if isURL(src) {
+		resp, err := (&http.Client{Timeout: 5 * time.Minute}).Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("fetching blocklist: %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+	if strings.HasSuffix(strings.SplitN(src, "?", 2)[0], ".gz") {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gzr.Close()
+		return parseBlocklist(gzr)
+	}
+	return parseBlocklist(r)
+}
+
+// startBlocklist loads the blocklists in the background.
+// Files are loaded again when they change, URLs every Settings.BlocklistInterval hours.
+func startBlocklist() {
+	bans := append([]string{}, settings.BannedIPs...)
+	sources := make([]*blocklistSource, len(settings.Blocklists))
+	for i, s := range settings.Blocklists {
+		sources[i] = &blocklistSource{Source: s}
+	}
+	interval := time.Duration(settings.BlocklistInterval) * time.Hour
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	update := func(force bool) {
+		for _, src := range sources {
+			reload := force || src.Loaded.IsZero()
+			if isURL(src.Source) {
+				reload = reload || time.Since(src.Loaded) >= interval
+			} else if fi, err := os.Stat(src.Source); err == nil && !fi.ModTime().Equal(src.ModTime) {
+				src.ModTime = fi.ModTime()
+				reload = true
+			}
+			if !reload {
+				continue
+			}
+			l, err := loadBlocklist(src.Source)
+			src.Loaded = time.Now()
+			src.Err = err
+			if err != nil {
+				logErrorf(nil, "blocklist %s: %s", src.Source, err)
+				continue
+			}
+			src.ranges = l
+			src.Ranges = len(l)
+			logDebugf(nil, "blocklist %s: loaded %d ranges", src.Source, len(l))
+		}
+
+		var all []iplist.Range
+		status := make([]blocklistSource, len(sources))
+		for i, src := range sources {
+			all = append(all, src.ranges...)
+			status[i] = *src
+			status[i].ranges = nil
+		}
+		for _, s := range bans {
+			if r, err := parseBan(s); err == nil {
+				all = append(all, r)
+			}
+		}
+		ipBlocklist.set(all)
+		dui.Call <- func() {
+			blocklistStatus = status
+		}
+	}
+
+	go func() {
+		update(false)
+		check := time.NewTicker(10 * time.Second)
+		for {
+			force := false
+			select {
+			case <-check.C:
+			case bans = <-blocklistBans:
+			case <-blocklistReload:
+				force = true
+			}
+			update(force)
+		}
+	}()
+}
+
+// banIP adds an IP or range to the banned IPs in the settings, and to the blocklist.
+func banIP(s string) error {
+	if _, err := parseBan(s); err != nil {
+		return err
+	}
+	for _, b := range settings.BannedIPs {
+		if b == s {
+			return nil
+		}
+	}
+	settings.BannedIPs = append(settings.BannedIPs, s)
+	saveSettings()
+	sendBans()
+	return nil
+}
+
+// unbanIP removes an IP or range from the banned IPs.
+func unbanIP(s string) {
+	var l []string
+	for _, b := range settings.BannedIPs {
+		if b != s {
+			l = append(l, b)
+		}
+	}
+	settings.BannedIPs = l
+	saveSettings()
+	sendBans()
+}
+
+// sendBans passes the banned IPs to the blocklist goroutine.
+// Only the latest list matters: one not yet received is replaced, so an older list can't win.
+// Called from the main loop only, so the send never blocks.
+func sendBans() {
+	select {
+	case <-blocklistBans:
+	default:
+	}
+	blocklistBans <- append([]string{}, settings.BannedIPs...)
+}
+
+// blocklistView returns the UI showing the state of the blocklist, with banned IPs.
+func blocklistView() duit.UI {
+	summary := &duit.Label{}
+	sourcesBox := &duit.Box{Width: -1}
+	bansBox := &duit.Box{Width: -1}
+	status := &duit.Label{}
+
+	makeGrid := func(kids ...duit.UI) *duit.Grid {
+		return &duit.Grid{
+			Columns: 2,
+			Padding: []duit.Space{
+				{Top: 2, Right: 4, Bottom: 2, Left: 0},
+				{Top: 2, Right: 0, Bottom: 2, Left: 4},
+			},
+			Width: -1,
+			Kids:  duit.NewKids(kids...),
+		}
+	}
+
+	var update func()
+	update = func() {
+		summary.Text = fmt.Sprintf("%d ranges loaded, %d connections refused", ipBlocklist.NumRanges(), atomic.LoadInt64(&ipBlocklist.refused))
+
+		var kids []duit.UI
+		for _, src := range blocklistStatus {
+			s := fmt.Sprintf("%d ranges, loaded %s", src.Ranges, src.Loaded.Format("2006-01-02 15:04"))
+			if src.Err != nil {
+				s += ", error: " + src.Err.Error()
+			}
+			kids = append(kids, &duit.Label{Text: src.Source}, &duit.Label{Text: s})
+		}
+		sourcesBox.Kids = duit.NewKids(makeGrid(kids...))
+
+		kids = nil
+		for _, b := range settings.BannedIPs {
+			b := b
+			kids = append(kids, &duit.Label{Text: b}, &duit.Button{
+				Text: "unban",
+				Click: func() (e duit.Event) {
+					unbanIP(b)
+					update()
+					dui.MarkLayout(nil)
+					return
+				},
+			})
+		}
+		bansBox.Kids = duit.NewKids(makeGrid(kids...))
+		dui.MarkLayout(nil)
+	}
+	update()
+	nextViewTick = update
+
+	var ban *duit.Field
+	ban = &duit.Field{
+		Placeholder: "ip, cidr or first-last...",
+		Keys: func(k rune, m draw.Mouse) (e duit.Event) {
+			if k == '\n' && ban.Text != "" {
+				e.Consumed = true
+				if err := banIP(ban.Text); err != nil {
+					status.Text = err.Error()
+				} else {
+					status.Text = ""
+					ban.Text = ""
+				}
+				update()
+			}
+			return
+		},
+	}
+
+	title := func(s string) duit.UI {
+		return &duit.Box{Padding: duit.Space{Top: 10}, Width: -1, Kids: duit.NewKids(&duit.Label{Text: s, Font: bold})}
+	}
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Blocklist", Font: bold},
+				&duit.Box{Width: -1, Kids: duit.NewKids(summary)},
+				title("Lists"),
+				sourcesBox,
+				title("Banned"),
+				bansBox,
+				&duit.Box{
+					Margin: image.Pt(6, 0),
+					Kids: duit.NewKids(
+						&duit.Box{Width: 250, Kids: duit.NewKids(ban)},
+						status,
+					),
+				},
+				&duit.Box{
+					Padding: duit.Space{Top: 10},
+					Margin:  image.Pt(6, 0),
+					Kids: duit.NewKids(
+						&duit.Button{
+							Text: "reload lists",
+							Click: func() (e duit.Event) {
+								go func() {
+									blocklistReload <- struct{}{}
+								}()
+								return
+							},
+						},
+						&duit.Button{
+							Text: "close",
+							Click: func() (e duit.Event) {
+								showMain()
+								return
+							},
+						},
+					),
+				},
+			),
+		}},
+	}
+}
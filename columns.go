@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// column can be shown in the torrent list.
+type column struct {
+	name   string
+	halign duit.Halign
+	value  func(t *torrent.Torrent) string
+	info   bool // whether value needs the torrent's info, otherwise it also works while migrating or fetching metainfo
+}
+
+// columns are all available columns, in the order shown in the column chooser.
+var columns = []column{
+	{"status", duit.HalignLeft, torrentStatus, false},
+	{"name", duit.HalignLeft, torrentName, false},
+	{"completed", duit.HalignRight, func(t *torrent.Torrent) string { return formatSize(t.BytesCompleted()) }, true},
+	{"total", duit.HalignRight, func(t *torrent.Torrent) string { return formatSize(t.Length()) }, true},
+	{"eta", duit.HalignRight, func(t *torrent.Torrent) string { return torrentETA[t.InfoHash()] }, false},
+	{"downrate", duit.HalignRight, func(t *torrent.Torrent) string { return formatRate(t, false) }, false},
+	{"uprate", duit.HalignRight, func(t *torrent.Torrent) string { return formatRate(t, true) }, false},
+	{"ratio", duit.HalignRight, func(t *torrent.Torrent) string {
+		if t.Length() == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.2f", shareRatio(t))
+	}, true},
+	{"uploaded", duit.HalignRight, func(t *torrent.Torrent) string { return formatSize(uploaded(t)) }, false},
+	{"downloaded", duit.HalignRight, func(t *torrent.Torrent) string { return formatSize(downloaded(t)) }, false},
+	{"seeds/peers", duit.HalignRight, func(t *torrent.Torrent) string {
+		s := torrentSwarm[t.InfoHash()]
+		return fmt.Sprintf("%d/%d", s.seeds, t.Stats().ActivePeers)
+	}, false},
+	{"active time", duit.HalignRight, func(t *torrent.Torrent) string { return formatDuration(totals(t.InfoHash()).active) }, false},
+	{"seeding time", duit.HalignRight, func(t *torrent.Torrent) string { return formatDuration(totals(t.InfoHash()).seeding) }, false},
+	{"added", duit.HalignLeft, func(t *torrent.Torrent) string { return formatTime(torrentAdded[t.InfoHash()]) }, false},
+	{"completed on", duit.HalignLeft, func(t *torrent.Torrent) string { return formatTime(torrentCompletedAt[t.InfoHash()]) }, false},
+	{"label", duit.HalignLeft, func(t *torrent.Torrent) string { return torrentLabel[t.InfoHash()] }, false},
+	{"save path", duit.HalignLeft, savePath, false},
+	{"infohash", duit.HalignLeft, func(t *torrent.Torrent) string { return t.InfoHash().HexString() }, false},
+	{"pieces", duit.HalignRight, func(t *torrent.Torrent) string { return fmt.Sprintf("%d", t.NumPieces()) }, true},
+	{"availability", duit.HalignRight, func(t *torrent.Torrent) string {
+		return fmt.Sprintf("%.2f", torrentSwarm[t.InfoHash()].availability)
+	}, true},
+	{"position", duit.HalignRight, func(t *torrent.Torrent) string { return fmt.Sprintf("%d", listPosition(t)) }, false},
+}
+
+var defaultColumns = []string{"status", "name", "completed", "total", "eta", "downrate", "uprate"}
+
+// swarm is what we know about the peers of a torrent, from the client status.
+type swarm struct {
+	seeds        int     // connected peers that have all pieces
+	availability float64 // copies of the torrent in the connected peers, estimated from their progress
+}
+
+var (
+	shownColumns []column // in the list, in order
+	torrentETA   map[metainfo.Hash]string
+	torrentSwarm map[metainfo.Hash]swarm
+)
+
+func formatTime(tm time.Time) string {
+	if tm.IsZero() {
+		return ""
+	}
+	return tm.Format("2006-01-02 15:04")
+}
+
+func formatRate(t *torrent.Torrent, up bool) string {
+	r, ok := torrentRate[t.InfoHash()]
+	if !ok {
+		return ""
+	}
+	if up {
+		return fmt.Sprintf("%dk", r.up/1024)
+	}
+	return fmt.Sprintf("%dk", r.down/1024)
+}
+
+// listPosition returns the 1-based position of t in the list of all torrents.
+// Only the order of the list, torrents are not queued, all wanted torrents are active.
+func listPosition(t *torrent.Torrent) int {
+	for i, row := range torrentRows {
+		if row.Value == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// torrentStatus returns the state of t as shown in the list.
+func torrentStatus(t *torrent.Torrent) string {
+	h := t.InfoHash()
+	if m := migrations[h]; m != nil {
+		return fmt.Sprintf("migrating %d%%", migrationProgress(m))
+	}
+	switch {
+	case t.Info() == nil:
+		return "starting"
+	case verifications[h] != nil && verifications[h].running:
+		return fmt.Sprintf("checking %d%%", verifyProgress(verifications[h]))
+	case t.Seeding():
+		return "seeding"
+	case !torrentWant[h]:
+		return "paused"
+	case bytesWantedMissing(t) == 0:
+		return "finished"
+	}
+	return "downloading"
+}
+
+// columnShown returns whether a column is in the list.
+func columnShown(name string) bool {
+	for _, c := range shownColumns {
+		if c.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyColumns shows the columns from the settings in the list.
+func applyColumns() {
+	names := settings.Columns
+	if len(names) == 0 {
+		names = defaultColumns
+	}
+	shownColumns = nil
+	for _, name := range names {
+		for _, c := range columns {
+			if c.name == name {
+				shownColumns = append(shownColumns, c)
+			}
+		}
+	}
+	if len(shownColumns) == 0 {
+		settings.Columns = nil
+		applyColumns()
+		return
+	}
+
+	var header []string
+	var halign []duit.Halign
+	for _, c := range shownColumns {
+		header = append(header, c.name)
+		halign = append(halign, c.halign)
+	}
+	list.Header = &duit.Gridrow{Values: header}
+	list.Halign = halign
+	// duit keeps the widths of the previous columns, and has no API for setting or reading them
+	*list = duit.Gridlist{
+		Header:   list.Header,
+		Rows:     list.Rows,
+		Multiple: list.Multiple,
+		Halign:   list.Halign,
+		Padding:  list.Padding,
+		Striped:  list.Striped,
+		Fit:      list.Fit,
+		Font:     list.Font,
+		Changed:  list.Changed,
+		Click:    list.Click,
+		Keys:     list.Keys,
+	}
+	for _, row := range torrentRows {
+		row.Values = make([]string, len(shownColumns))
+		updateRow(row, false)
+	}
+	dui.MarkLayout(nil)
+}
+
+// updateSwarms sets torrentSwarm from the client status, only when a column needs it.
+func updateSwarms() {
+	if !columnShown("seeds/peers") && !columnShown("availability") {
+		return
+	}
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		if migrations[t.InfoHash()] != nil {
+			continue
+		}
+		var s swarm
+		peers, _ := parseStatus(clientStatus(t))
+		for _, p := range peers {
+			l := strings.Split(p.pieces, "/")
+			if len(l) != 2 {
+				continue
+			}
+			have, _ := strconv.Atoi(l[0])
+			total, _ := strconv.Atoi(l[1])
+			if total == 0 {
+				continue
+			}
+			if have == total {
+				s.seeds++
+			}
+			s.availability += float64(have) / float64(total)
+		}
+		torrentSwarm[t.InfoHash()] = s
+	}
+}
+
+// columnsView returns the UI for choosing and ordering the columns of the list.
+func columnsView() duit.UI {
+	type choice struct {
+		name  string
+		shown *duit.Checkbox
+	}
+	var choices []choice
+	for _, c := range shownColumns {
+		choices = append(choices, choice{c.name, &duit.Checkbox{Checked: true}})
+	}
+	for _, c := range columns {
+		if !columnShown(c.name) {
+			choices = append(choices, choice{c.name, &duit.Checkbox{}})
+		}
+	}
+
+	grid := &duit.Grid{
+		Columns: 4,
+		Padding: []duit.Space{
+			{Top: 2, Right: 4, Bottom: 2, Left: 0},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 0, Bottom: 2, Left: 4},
+		},
+	}
+	var setGrid func()
+	move := func(text string, i, j int) *duit.Button {
+		return &duit.Button{
+			Text:     text,
+			Disabled: j < 0 || j >= len(choices),
+			Click: func() (e duit.Event) {
+				choices[i], choices[j] = choices[j], choices[i]
+				setGrid()
+				return
+			},
+		}
+	}
+	setGrid = func() {
+		var kids []duit.UI
+		for i, c := range choices {
+			kids = append(kids, c.shown, &duit.Label{Text: c.name}, move("up", i, i-1), move("down", i, i+1))
+		}
+		grid.Kids = duit.NewKids(kids...)
+		dui.MarkLayout(nil)
+	}
+	setGrid()
+
+	status := &duit.Label{}
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Columns", Font: bold},
+				&duit.Label{Text: "position is the place in the list, availability is estimated from the progress of connected peers"},
+				grid,
+				&duit.Box{
+					Margin: image.Pt(6, 0),
+					Kids: duit.NewKids(
+						&duit.Button{
+							Text:     "apply",
+							Colorset: &dui.Primary,
+							Click: func() (e duit.Event) {
+								var names []string
+								for _, c := range choices {
+									if c.shown.Checked {
+										names = append(names, c.name)
+									}
+								}
+								if len(names) == 0 {
+									status.Text = "at least one column required"
+									dui.MarkLayout(nil)
+									return
+								}
+								settings.Columns = names
+								saveSettings()
+								applyColumns()
+								showMain()
+								return
+							},
+						},
+						&duit.Button{
+							Text: "defaults",
+							Click: func() (e duit.Event) {
+								settings.Columns = nil
+								saveSettings()
+								applyColumns()
+								showMain()
+								return
+							},
+						},
+						&duit.Button{
+							Text: "cancel",
+							Click: func() (e duit.Event) {
+								showMain()
+								return
+							},
+						},
+						status,
+					),
+				},
+			),
+		}},
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// completion keeps track of which pieces have been verified, in a bolt database in the application data directory.
+// This lets a restart resume without hashing all data again.
+// Pieces of data files that were modified while we were not running are reported as unknown, so they get checked again.
+type completion struct {
+	storage.PieceCompletion
+
+	sync.Mutex
+	unknown map[metainfo.PieceKey]bool
+}
+
+var pieceCompletion *completion
+
+func openPieceCompletion() {
+	pc, err := storage.NewBoltPieceCompletion(appDataDir())
+	check(err, "opening piece completion database")
+	pieceCompletion = &completion{PieceCompletion: pc, unknown: map[metainfo.PieceKey]bool{}}
+}
+
+func (c *completion) Get(pk metainfo.PieceKey) (storage.Completion, error) {
+	c.Lock()
+	unknown := c.unknown[pk]
+	c.Unlock()
+	if unknown {
+		return storage.Completion{}, nil
+	}
+	return c.PieceCompletion.Get(pk)
+}
+
+func (c *completion) Set(pk metainfo.PieceKey, complete bool) error {
+	c.Lock()
+	delete(c.unknown, pk)
+	c.Unlock()
+	return c.PieceCompletion.Set(pk, complete)
+}
+
+// Close does nothing: the completion is shared by all storages, some of which close it when a torrent is dropped.
+// Use closePieceCompletion at exit.
+func (c *completion) Close() error {
+	return nil
+}
+
+func closePieceCompletion() {
+	err := pieceCompletion.PieceCompletion.Close()
+	if err != nil {
+		logErrorf(nil, "closing piece completion database: %s", err)
+	}
+}
+
+// fileStorage returns file storage for dir that uses the shared piece completion.
+func fileStorage(dir string) storage.ClientImpl {
+	return storage.NewFileWithCompletion(dir, pieceCompletion)
+}
+
+// dataFile is the size and modification time of a file with torrent data, for detecting changes between runs.
+type dataFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// statDataFiles returns the current state of the data files of a torrent stored in dir.
+// Files that don't exist are skipped.
+func statDataFiles(info *metainfo.Info, dir string) []dataFile {
+	var r []dataFile
+	for _, fi := range info.UpvertedFiles() {
+		p := filepath.Join(append([]string{info.Name}, fi.Path...)...)
+		st, err := os.Stat(filepath.Join(dir, p))
+		if err != nil {
+			continue
+		}
+		r = append(r, dataFile{p, st.Size(), st.ModTime()})
+	}
+	return r
+}
+
+// invalidateChanged marks pieces of files that changed since they were last recorded as unknown.
+// Must be called before the torrent is added to the client.
+func invalidateChanged(h metainfo.Hash, info *metainfo.Info, dir string, recorded []dataFile) {
+	prev := map[string]dataFile{}
+	for _, f := range recorded {
+		prev[f.Path] = f
+	}
+	cur := map[string]dataFile{}
+	for _, f := range statDataFiles(info, dir) {
+		cur[f.Path] = f
+	}
+
+	pieceLength := info.PieceLength
+	var offset int64
+	n := 0
+	for _, fi := range info.UpvertedFiles() {
+		p := filepath.Join(append([]string{info.Name}, fi.Path...)...)
+		o, ok0 := prev[p]
+		c, ok1 := cur[p]
+		if fi.Length > 0 && (ok0 != ok1 || o.Size != c.Size || !o.ModTime.Equal(c.ModTime)) {
+			pieceCompletion.Lock()
+			for i := offset / pieceLength; i*pieceLength < offset+fi.Length; i++ {
+				pieceCompletion.unknown[metainfo.PieceKey{InfoHash: h, Index: int(i)}] = true
+				n++
+			}
+			pieceCompletion.Unlock()
+		}
+		offset += fi.Length
+	}
+	if n > 0 {
+		logInfof(nil, "%s: data files changed, checking %d pieces again", info.Name, n)
+	}
+}
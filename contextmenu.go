@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/mjl-/duit"
+)
+
+var lastMouse image.Point // in window, for placing the context menu
+
+// menuPlace shows a context menu on top of the main UI.
+// A click outside the menu, or escape, closes it.
+type menuPlace struct {
+	duit.Place
+	main, menu *duit.Kid
+}
+
+func (ui *menuPlace) Draw(dui *duit.DUI, self *duit.Kid, img *draw.Image, orig image.Point, m draw.Mouse, force bool) {
+	// main UI may draw over the menu
+	if ui.main.Draw != duit.Clean {
+		ui.menu.Draw = duit.Dirty
+	}
+	ui.Place.Draw(dui, self, img, orig, m, force)
+}
+
+func (ui *menuPlace) Mouse(dui *duit.DUI, self *duit.Kid, m draw.Mouse, origM draw.Mouse, orig image.Point) (r duit.Result) {
+	if m.Buttons != 0 && !m.Point.In(ui.menu.R) {
+		closeMenu()
+		r.Consumed = true
+		return
+	}
+	return ui.Place.Mouse(dui, self, m, origM, orig)
+}
+
+func (ui *menuPlace) Key(dui *duit.DUI, self *duit.Kid, k rune, m draw.Mouse, orig image.Point) (r duit.Result) {
+	if k == draw.KeyEscape {
+		closeMenu()
+		r.Consumed = true
+		return
+	}
+	return ui.Place.Key(dui, self, k, m, orig)
+}
+
+// openMenu shows a menu with entries at the last mouse position.
+func openMenu(entries ...duit.UI) {
+	p := lastMouse
+	ui := &menuPlace{
+		main: &duit.Kid{UI: top},
+		menu: &duit.Kid{UI: &duit.Box{
+			Padding:    duit.SpaceXY(4, 4),
+			Background: dui.Striped.Background,
+			Kids: duit.NewKids(&duit.Grid{
+				Columns: 1,
+				Padding: []duit.Space{{Top: 1, Bottom: 1}},
+				Kids:    duit.NewKids(entries...),
+			}),
+		}},
+	}
+	ui.Kids = []*duit.Kid{ui.main, ui.menu}
+	ui.Place.Place = func(self *duit.Kid, sizeAvail image.Point) {
+		ui.main.UI.Layout(dui, ui.main, sizeAvail, true)
+		ui.main.R = image.Rectangle{Max: sizeAvail}
+		ui.menu.UI.Layout(dui, ui.menu, sizeAvail, true)
+		size := ui.menu.R.Size()
+		q := p
+		if q.X+size.X > sizeAvail.X {
+			q.X = sizeAvail.X - size.X
+		}
+		if q.Y+size.Y > sizeAvail.Y {
+			q.Y = sizeAvail.Y - size.Y
+		}
+		if q.X < 0 {
+			q.X = 0
+		}
+		if q.Y < 0 {
+			q.Y = 0
+		}
+		ui.menu.R = image.Rectangle{q, q.Add(size)}
+		self.R = image.Rectangle{Max: sizeAvail}
+	}
+	dui.Top.UI = ui
+	dui.MarkLayout(nil)
+}
+
+func closeMenu() {
+	dui.Top.UI = top
+	dui.MarkLayout(nil)
+}
+
+// selectedTorrents returns the torrents of the selected rows.
+func selectedTorrents() []*torrent.Torrent {
+	var l []*torrent.Torrent
+	for _, i := range list.Selected() {
+		l = append(l, list.Rows[i].Value.(*torrent.Torrent))
+	}
+	return l
+}
+
+// rowMenu opens the context menu for the row at index, selecting it if it isn't already.
+func rowMenu(index int) {
+	if index < 0 || index >= len(list.Rows) {
+		return
+	}
+	if !list.Rows[index].Selected {
+		selectRow(index)
+	}
+	l := selectedTorrents()
+
+	// an action is enabled when it applies to any of the selected torrents
+	applies := func(fn func(t *torrent.Torrent) bool) bool {
+		for _, t := range l {
+			if fn(t) {
+				return true
+			}
+		}
+		return false
+	}
+	idle := func(t *torrent.Torrent) bool {
+		return migrations[t.InfoHash()] == nil
+	}
+	entry := func(text string, enabled bool, fn func()) duit.UI {
+		return &duit.Button{
+			Text:     text,
+			Disabled: !enabled,
+			Click: func() (e duit.Event) {
+				closeMenu()
+				fn()
+				return
+			},
+		}
+	}
+	each := func(fn func(t *torrent.Torrent)) func() {
+		return func() {
+			for _, t := range l {
+				fn(t)
+			}
+		}
+	}
+
+	openMenu(
+		entry("start", applies(func(t *torrent.Torrent) bool { return idle(t) && !torrentWant[t.InfoHash()] }), each(func(t *torrent.Torrent) {
+			if idle(t) {
+				setWant(t, true)
+			}
+		})),
+		entry("pause", applies(func(t *torrent.Torrent) bool { return idle(t) && torrentWant[t.InfoHash()] }), each(func(t *torrent.Torrent) {
+			if idle(t) {
+				setWant(t, false)
+			}
+		})),
+		entry("remove", applies(idle), func() {
+			showView(confirmRemoveView(l, false))
+		}),
+		entry("remove with data", applies(idle), func() {
+			showView(confirmRemoveView(l, true))
+		}),
+		entry("verify", applies(func(t *torrent.Torrent) bool { return idle(t) && t.Info() != nil && !verifying(t) }), each(func(t *torrent.Torrent) {
+			if idle(t) {
+				startVerify(t)
+				updateRow(findRow(t), false)
+			}
+		})),
+		entry("move data...", applies(func(t *torrent.Torrent) bool { return idle(t) && t.Info() != nil }), func() {
+			showView(moveView(l))
+		}),
+		entry("enable local discovery", applies(func(t *torrent.Torrent) bool { return torrentNoLSD[t.InfoHash()] }), each(func(t *torrent.Torrent) {
+			delete(torrentNoLSD, t.InfoHash())
+			lsdLast = time.Time{}
+			saveSession()
+		})),
+		entry("disable local discovery", applies(func(t *torrent.Torrent) bool { return !torrentNoLSD[t.InfoHash()] }), each(func(t *torrent.Torrent) {
+			torrentNoLSD[t.InfoHash()] = true
+			saveSession()
+		})),
+		entry("copy magnet", true, func() {
+			for _, t := range l {
+				if isPrivate(t) {
+					showView(confirmCopyMagnetView(l))
+					return
+				}
+			}
+			copyMagnets(l)
+		}),
+		entry("copy infohash", true, func() {
+			var s []string
+			for _, t := range l {
+				h := t.InfoHash()
+				s = append(s, hex.EncodeToString(h[:]))
+			}
+			dui.WriteSnarf([]byte(strings.Join(s, "\n")))
+		}),
+		entry("open folder", applies(func(t *torrent.Torrent) bool { return dirExists(torrentFolder(t)) }), each(func(t *torrent.Torrent) {
+			if dir := torrentFolder(t); dirExists(dir) {
+				openFolder(t, dir)
+			}
+		})),
+		entry("set label...", true, func() {
+			showView(labelView(l))
+		}),
+		entry("set limits...", true, func() {
+			showView(limitsView(l))
+		}),
+	)
+}
+
+// torrentFolder returns the directory with the data of t.
+func torrentFolder(t *torrent.Torrent) string {
+	p := savePath(t)
+	if torrentBackend(t.InfoHash()) == "bolt" {
+		p = filepath.Dir(p)
+	}
+	return p
+}
+
+func dirExists(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+// openFolder opens dir in the file manager of the system.
+func openFolder(t *torrent.Torrent, dir string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", dir)
+	case "windows":
+		cmd = exec.Command("explorer", dir)
+	case "plan9":
+		cmd = exec.Command("plumb", dir)
+	default:
+		cmd = exec.Command("xdg-open", dir)
+	}
+	if err := cmd.Start(); err != nil {
+		logErrorf(t, "open folder: %s", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// moveView returns the UI for moving the data of torrents to another directory.
+func moveView(l []*torrent.Torrent) duit.UI {
+	dir := defaultDataDir()
+	if len(l) == 1 && torrentDir[l[0].InfoHash()] != "" {
+		dir = torrentDir[l[0].InfoHash()]
+	}
+	field := &duit.Field{Text: dir}
+	status := &duit.Label{}
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(6, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: fmt.Sprintf("Move data of %d torrents to directory:", len(l)), Font: bold},
+			&duit.Box{Width: 400, Kids: duit.NewKids(field)},
+			&duit.Button{
+				Text:     "move",
+				Colorset: &dui.Primary,
+				Click: func() (e duit.Event) {
+					if field.Text == "" {
+						status.Text = "directory required"
+						dui.MarkLayout(nil)
+						return
+					}
+					for _, t := range l {
+						if findRow(t) != nil {
+							startMigration(t, torrentBackend(t.InfoHash()), field.Text)
+							updateRow(findRow(t), false)
+						}
+					}
+					showMain()
+					updateButtons(selected())
+					updateDetails(selected())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "cancel",
+				Click: func() (e duit.Event) {
+					showMain()
+					return
+				},
+			},
+			status,
+		),
+	}
+}
+
+// labelView returns the UI for setting the label of torrents.
+func labelView(l []*torrent.Torrent) duit.UI {
+	label := ""
+	if len(l) == 1 {
+		label = torrentLabel[l[0].InfoHash()]
+	}
+	field := &duit.Field{Text: label}
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(6, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: fmt.Sprintf("Label for %d torrents:", len(l)), Font: bold},
+			&duit.Box{Width: 200, Kids: duit.NewKids(field)},
+			&duit.Button{
+				Text:     "set",
+				Colorset: &dui.Primary,
+				Click: func() (e duit.Event) {
+					for _, t := range l {
+						setLabel(t, field.Text)
+					}
+					saveSession()
+					showMain()
+					filterRows()
+					updateLabels()
+					updateButtons(selected())
+					updateDetails(selected())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "cancel",
+				Click: func() (e duit.Event) {
+					showMain()
+					return
+				},
+			},
+		),
+	}
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"github.com/mjl-/duit"
+)
+
+// tabs of the details pane
+const (
+	tabGeneral = iota
+	tabFiles
+	tabPeers
+	tabTrackers
+	tabPieces
+	tabLog
+)
+
+var detailTabs = []string{"General", "Files", "Peers", "Trackers", "Pieces", "Log"}
+
+// detailsPane shows a torrent in the details pane.
+// Its widgets are kept while the same torrent is selected and in the same state, ticks only change their values.
+// This keeps the scroll position and edit state.
+type detailsPane struct {
+	t       *torrent.Torrent
+	state   string // "migrating", "fetching" (metainfo) or "ready", a change rebuilds the pane
+	tabs    *duit.Tabs
+	changed bool // whether a value changed, requiring a layout
+
+	general  *valueGrid
+	files    []*duit.Label // progress per file
+	peers    *duit.Gridlist
+	trackers *duit.Gridlist
+	pieces   *valueGrid
+	pieceMap *duit.Label
+	log      *duit.Gridlist
+	logSeq   int
+}
+
+var (
+	pane       *detailsPane
+	detailsTab = tabGeneral // kept when another torrent is selected
+)
+
+// valueGrid is a grid with names and values, the values can be changed in place.
+type valueGrid struct {
+	grid   *duit.Grid
+	values map[string]*duit.Label
+}
+
+func newValueGrid(names ...string) *valueGrid {
+	g := &valueGrid{values: map[string]*duit.Label{}}
+	var kids []duit.UI
+	for _, name := range names {
+		v := &duit.Label{}
+		g.values[name] = v
+		kids = append(kids, &duit.Label{Text: name}, v)
+	}
+	g.grid = &duit.Grid{
+		Columns: 2,
+		Padding: []duit.Space{
+			{Top: 2, Right: 4, Bottom: 2, Left: 0},
+			{Top: 2, Right: 0, Bottom: 2, Left: 4},
+		},
+		Width: -1,
+		Kids:  duit.NewKids(kids...),
+	}
+	return g
+}
+
+func (p *detailsPane) set(l *duit.Label, s string) {
+	if l.Text != s {
+		l.Text = s
+		p.changed = true
+	}
+}
+
+func (p *detailsPane) setValue(g *valueGrid, name, s string) {
+	p.set(g.values[name], s)
+}
+
+func (p *detailsPane) setRows(l *duit.Gridlist, values [][]string) {
+	same := len(values) == len(l.Rows)
+	for i := 0; same && i < len(values); i++ {
+		same = strings.Join(values[i], "\t") == strings.Join(l.Rows[i].Values, "\t")
+	}
+	if same {
+		return
+	}
+	rows := make([]*duit.Gridrow, len(values))
+	for i, v := range values {
+		rows[i] = &duit.Gridrow{Values: v}
+	}
+	l.Rows = rows
+	p.changed = true
+}
+
+// updateDetails shows t in the details pane, or nothing for nil.
+// The pane is rebuilt when another torrent is selected or its state changed, otherwise its values are updated in place.
+func updateDetails(t *torrent.Torrent) {
+	state := ""
+	if t != nil {
+		state = "ready"
+		if migrations[t.InfoHash()] != nil {
+			state = "migrating"
+		} else if t.Info() == nil {
+			state = "fetching"
+		}
+	}
+	if pane == nil || pane.t != t || pane.state != state {
+		pane = newDetailsPane(t, state)
+		dui.MarkLayout(nil)
+	}
+	pane.update()
+	if pane.changed {
+		pane.changed = false
+		dui.MarkLayout(nil)
+	}
+}
+
+func newDetailsPane(t *torrent.Torrent, state string) *detailsPane {
+	p := &detailsPane{t: t, state: state, logSeq: -1}
+	switch state {
+	case "":
+		details.Kids = nil
+		return p
+	case "migrating":
+		details.Kids = duit.NewKids(&duit.Label{Text: "migrating storage..."})
+		return p
+	}
+
+	tab := func(uis ...duit.UI) duit.UI {
+		return &duit.Scroll{
+			Height: -1,
+			Kid: duit.Kid{UI: &duit.Box{
+				Padding: duit.SpaceXY(0, 4),
+				Margin:  image.Pt(0, 4),
+				Kids:    duit.NewKids(uis...),
+			}},
+		}
+	}
+	gridlist := func(header ...string) *duit.Gridlist {
+		return &duit.Gridlist{
+			Header:  &duit.Gridrow{Values: header},
+			Padding: duit.SpaceXY(2, 2),
+			Striped: true,
+		}
+	}
+
+	uis := []duit.UI{
+		tab(p.generalUIs()...),
+		tab(p.filesUIs()...),
+		nil,
+		nil,
+		tab(p.piecesUIs()...),
+		nil,
+	}
+	p.peers = gridlist("address", "client", "pieces", "flags", "down")
+	p.peers.Halign = []duit.Halign{duit.HalignLeft, duit.HalignLeft, duit.HalignRight, duit.HalignLeft, duit.HalignRight}
+	uis[tabPeers] = tab(p.peers, peersField(t), webSeedField(t))
+	p.trackers = gridlist("tier", "url", "next announce", "last announce")
+	uis[tabTrackers] = tab(p.trackers, trackerField(t))
+	p.log = gridlist("time", "level", "message")
+	uis[tabLog] = tab(p.log)
+
+	tabs := &duit.Tabs{
+		Buttongroup: &duit.Buttongroup{Texts: detailTabs, Selected: detailsTab},
+		UIs:         uis,
+	}
+	// like duit.Tabs does itself, but we also update the newly shown tab
+	tabs.Box.Kids = duit.NewKids(duit.CenterUI(duit.SpaceXY(4, 4), tabs.Buttongroup), uis[detailsTab])
+	tabs.Buttongroup.Changed = func(index int) (e duit.Event) {
+		detailsTab = index
+		tabs.Box.Kids[1].UI = uis[index]
+		p.update()
+		p.changed = false
+		e.Consumed = true
+		e.NeedLayout = true
+		return
+	}
+	p.tabs = tabs
+	details.Kids = duit.NewKids(tabs)
+	return p
+}
+
+func (p *detailsPane) generalUIs() []duit.UI {
+	t := p.t
+	h := t.InfoHash()
+	p.general = newValueGrid(
+		"Name",
+		"Status",
+		"Label",
+		"Private",
+		"Local discovery",
+		"Saved in",
+		"Storage",
+		"Size",
+		"Completed",
+		"Seed ratio",
+		"Downloaded, all time",
+		"Uploaded, all time",
+		"Share ratio",
+		"Active time",
+		"Seeding time",
+		"Active peers",
+		"Half open peers",
+		"Pending peers",
+		"Total peers",
+		"Chunks written",
+		"Chunks read",
+		"Data written",
+		"Data read",
+	)
+	uis := []duit.UI{p.general.grid}
+	if p.state != "ready" {
+		return uis
+	}
+
+	storageGroup := &duit.Buttongroup{
+		Texts: storageBackends,
+		Changed: func(index int) (e duit.Event) {
+			startMigration(t, storageBackends[index], "")
+			updateRow(findRow(t), false)
+			updateButtons(t)
+			updateDetails(t)
+			dui.MarkLayout(nil)
+			return
+		},
+	}
+	for index, b := range storageBackends {
+		if b == torrentBackend(h) {
+			storageGroup.Selected = index
+		}
+	}
+	uis = append(uis,
+		&duit.Box{Padding: duit.Space{Top: 6}, Width: -1, Kids: duit.NewKids(&duit.Label{Text: "Move data to storage", Font: bold})},
+		storageGroup,
+	)
+	if streamBase != "" {
+		url := playlistURL(t)
+		uis = append(uis, &duit.Button{
+			Text: "copy playlist url",
+			Click: func() (e duit.Event) {
+				dui.WriteSnarf([]byte(url))
+				return
+			},
+		})
+	}
+	return uis
+}
+
+func (p *detailsPane) filesUIs() []duit.UI {
+	t := p.t
+	if p.state != "ready" {
+		return []duit.UI{&duit.Label{Text: "fetching metainfo..."}}
+	}
+	var kids []duit.UI
+	h := t.InfoHash()
+	n := len(t.Files())
+	for index, f := range t.Files() {
+		index := index
+		progress := &duit.Label{}
+		p.files = append(p.files, progress)
+		check := &duit.Checkbox{Checked: fileWanted(h, index)}
+		check.Changed = func() (e duit.Event) {
+			sel := make([]bool, n)
+			for i := range sel {
+				sel[i] = fileWanted(h, i)
+			}
+			sel[index] = check.Checked
+			setFileSelection(t, sel)
+			saveSession()
+			updateRow(findRow(t), false)
+			dui.MarkLayout(nil)
+			return
+		}
+		kids = append(kids, check, &duit.Label{Text: f.Path()}, &duit.Label{Text: formatSize(f.Length())}, progress)
+		if streamBase != "" {
+			url := streamURL(t, index)
+			kids = append(kids, &duit.Button{
+				Text: "copy stream url",
+				Click: func() (e duit.Event) {
+					dui.WriteSnarf([]byte(url))
+					return
+				},
+			})
+		}
+	}
+	grid := &duit.Grid{
+		Columns: 4,
+		Padding: []duit.Space{
+			{Top: 2, Right: 4, Bottom: 2, Left: 0},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 0, Bottom: 2, Left: 4},
+		},
+		Width:  -1,
+		Halign: []duit.Halign{duit.HalignLeft, duit.HalignLeft, duit.HalignRight, duit.HalignRight},
+		Kids:   duit.NewKids(kids...),
+	}
+	if streamBase != "" {
+		grid.Columns = 5
+		grid.Padding = append(grid.Padding, duit.Space{Top: 2, Right: 0, Bottom: 2, Left: 4})
+		grid.Halign = append(grid.Halign, duit.HalignLeft)
+	}
+	return []duit.UI{grid}
+}
+
+func (p *detailsPane) piecesUIs() []duit.UI {
+	if p.state != "ready" {
+		return []duit.UI{&duit.Label{Text: "fetching metainfo..."}}
+	}
+	p.pieces = newValueGrid(
+		"Pieces",
+		"Piece length",
+		"Complete",
+		"Partial",
+		"Checking",
+		"Missing",
+		"Verification",
+		"Bad pieces",
+		"Affected files",
+	)
+	p.pieceMap = &duit.Label{}
+	return []duit.UI{
+		p.pieces.grid,
+		&duit.Box{Padding: duit.Space{Top: 6}, Width: -1, Kids: duit.NewKids(&duit.Label{Text: "Map (# complete, + partial, . missing)", Font: bold})},
+		p.pieceMap,
+	}
+}
+
+// update sets the values of the general tab, and of the tab that is shown.
+func (p *detailsPane) update() {
+	if p.tabs == nil {
+		return
+	}
+	p.updateGeneral()
+	switch detailsTab {
+	case tabFiles:
+		p.updateFiles()
+	case tabPeers, tabTrackers:
+		p.updateStatus()
+	case tabPieces:
+		p.updatePieces()
+	case tabLog:
+		p.updateLog()
+	}
+}
+
+func (p *detailsPane) updateGeneral() {
+	t := p.t
+	h := t.InfoHash()
+	g := p.general
+	p.setValue(g, "Name", t.Name())
+	p.setValue(g, "Status", torrentStatus(t))
+	p.setValue(g, "Label", torrentLabel[h])
+	private := "?"
+	if t.Info() != nil {
+		private = "no"
+		if isPrivate(t) {
+			private = "yes, peers from trackers only"
+		}
+	}
+	p.setValue(g, "Private", private)
+	lsd := "yes"
+	switch {
+	case settings.Network.NoLSD:
+		lsd = "disabled in network settings"
+	case torrentNoLSD[h]:
+		lsd = "disabled for torrent"
+	case t.Info() == nil:
+		lsd = "not until info is known"
+	case isPrivate(t):
+		lsd = "no, private torrent"
+	}
+	p.setValue(g, "Local discovery", lsd)
+	p.setValue(g, "Saved in", savePath(t))
+	p.setValue(g, "Storage", torrentBackend(h))
+	size, completed := "?", "?"
+	if t.Info() != nil {
+		size = formatSize(t.Length())
+		completed = formatSize(t.BytesCompleted())
+	}
+	p.setValue(g, "Size", size)
+	p.setValue(g, "Completed", completed)
+	goal := "none"
+	if r := seedRatio(h); r > 0 {
+		goal = fmt.Sprintf("%v", r)
+	}
+	p.setValue(g, "Seed ratio", goal)
+	tt := totals(h)
+	ratio := "?"
+	if t.Info() != nil {
+		ratio = fmt.Sprintf("%.2f", shareRatio(t))
+	}
+	p.setValue(g, "Downloaded, all time", formatSize(tt.downloaded))
+	p.setValue(g, "Uploaded, all time", formatSize(tt.uploaded))
+	p.setValue(g, "Share ratio", ratio)
+	p.setValue(g, "Active time", formatDuration(tt.active))
+	p.setValue(g, "Seeding time", formatDuration(tt.seeding))
+
+	ts := t.Stats()
+	p.setValue(g, "Active peers", fmt.Sprintf("%d", ts.ActivePeers))
+	p.setValue(g, "Half open peers", fmt.Sprintf("%d", ts.HalfOpenPeers))
+	p.setValue(g, "Pending peers", fmt.Sprintf("%d", ts.PendingPeers))
+	p.setValue(g, "Total peers", fmt.Sprintf("%d", ts.TotalPeers))
+	p.setValue(g, "Chunks written", fmt.Sprintf("%d", ts.ConnStats.ChunksWritten.Int64()))
+	p.setValue(g, "Chunks read", fmt.Sprintf("%d", ts.ConnStats.ChunksRead.Int64()))
+	p.setValue(g, "Data written", formatSize(ts.ConnStats.BytesWritten.Int64()))
+	p.setValue(g, "Data read", formatSize(ts.ConnStats.BytesRead.Int64()))
+}
+
+func (p *detailsPane) updateFiles() {
+	if p.files == nil {
+		return
+	}
+	for i, f := range p.t.Files() {
+		have := fileCompleted(f)
+		progress := "100%"
+		if f.Length() > 0 {
+			progress = fmt.Sprintf("%d%%", have*100/f.Length())
+		}
+		p.set(p.files[i], progress)
+	}
+}
+
+func (p *detailsPane) updatePieces() {
+	if p.pieces == nil {
+		return
+	}
+	t := p.t
+	g := p.pieces
+	var complete, partial, checking, missing int
+	runs := t.PieceStateRuns()
+	for _, r := range runs {
+		switch {
+		case r.Complete:
+			complete += r.Length
+		case r.Checking:
+			checking += r.Length
+		case r.Partial:
+			partial += r.Length
+		default:
+			missing += r.Length
+		}
+	}
+	p.setValue(g, "Pieces", fmt.Sprintf("%d", t.NumPieces()))
+	p.setValue(g, "Piece length", fmt.Sprintf("%d", t.Info().PieceLength))
+	p.setValue(g, "Complete", fmt.Sprintf("%d", complete))
+	p.setValue(g, "Partial", fmt.Sprintf("%d", partial))
+	p.setValue(g, "Checking", fmt.Sprintf("%d", checking))
+	p.setValue(g, "Missing", fmt.Sprintf("%d", missing))
+
+	verification, bad, files := "never", "", ""
+	if v := verifications[t.InfoHash()]; v != nil {
+		if v.running {
+			verification = fmt.Sprintf("running, %d%%", verifyProgress(v))
+		} else {
+			verification = "finished " + v.finished.Format("2006-01-02 15:04:05")
+			bad = fmt.Sprintf("%d", len(v.bad))
+			files = "none"
+			if len(v.badFiles) > 0 {
+				files = strings.Join(v.badFiles, "\n")
+			}
+		}
+	}
+	p.setValue(g, "Verification", verification)
+	p.setValue(g, "Bad pieces", bad)
+	p.setValue(g, "Affected files", files)
+	p.set(p.pieceMap, pieceMap(runs, t.NumPieces()))
+}
+
+// pieceMap returns at most 512 characters, each for a range of pieces: # if all are complete, . if none have data, + otherwise.
+func pieceMap(runs []torrent.PieceStateRun, n int) string {
+	const max = 512
+	if n == 0 {
+		return ""
+	}
+	buckets := n
+	if buckets > max {
+		buckets = max
+	}
+	complete := make([]int, buckets)
+	data := make([]int, buckets)
+	size := make([]int, buckets)
+	i := 0
+	for _, r := range runs {
+		for j := 0; j < r.Length; j, i = j+1, i+1 {
+			b := i * buckets / n
+			size[b]++
+			if r.Complete {
+				complete[b]++
+			}
+			if r.Complete || r.Partial {
+				data[b]++
+			}
+		}
+	}
+	s := make([]byte, buckets)
+	for b := range s {
+		switch {
+		case complete[b] == size[b]:
+			s[b] = '#'
+		case data[b] == 0:
+			s[b] = '.'
+		default:
+			s[b] = '+'
+		}
+	}
+	return string(s)
+}
+
+func (p *detailsPane) updateLog() {
+	eventLog.Lock()
+	if p.logSeq == eventLog.seq {
+		eventLog.Unlock()
+		return
+	}
+	p.logSeq = eventLog.seq
+	l := append([]logEntry{}, eventLog.entries...)
+	eventLog.Unlock()
+
+	h := p.t.InfoHash()
+	var values [][]string
+	for i := len(l) - 1; i >= 0; i-- {
+		if e := l[i]; e.hash == h {
+			values = append(values, []string{e.time.Format("2006-01-02 15:04:05"), logLevels[e.level], e.text})
+		}
+	}
+	p.setRows(p.log, values)
+}
+
+// updateStatus sets the peers and trackers from the status of the torrent in the client.
+func (p *detailsPane) updateStatus() {
+	peers, announces := parseStatus(clientStatus(p.t))
+
+	manual := map[string]bool{}
+	for _, s := range torrentManualPeers[p.t.InfoHash()] {
+		manual[s] = true
+	}
+	var values [][]string
+	for _, ps := range peers {
+		flags := ps.flags
+		if manual[ps.addr] {
+			flags = strings.TrimSpace("manual " + flags)
+			delete(manual, ps.addr)
+		}
+		values = append(values, []string{ps.addr, ps.client, ps.pieces, flags, ps.rate})
+	}
+	for _, s := range torrentManualPeers[p.t.InfoHash()] {
+		if manual[s] {
+			values = append(values, []string{s, "", "", "manual, not connected", ""})
+		}
+	}
+	for _, ws := range webSeeds[p.t.InfoHash()] {
+		if ws.t != p.t {
+			continue
+		}
+		pieces, state := ws.status()
+		values = append(values, []string{ws.url, "web seed", fmt.Sprintf("%d good", pieces), state, fmt.Sprintf("%.1f KiB/s", float64(ws.rate)/1024)})
+	}
+	p.setRows(p.peers, values)
+
+	values = nil
+	for i, tier := range p.t.Metainfo().AnnounceList {
+		tier = append([]string{}, tier...)
+		sort.Strings(tier)
+		for _, url := range tier {
+			a, ok := announces[url]
+			if !ok {
+				a = [2]string{"", "not enabled"}
+			}
+			values = append(values, []string{fmt.Sprintf("%d", i+1), url, a[0], a[1]})
+		}
+	}
+	p.setRows(p.trackers, values)
+}
+
+// peerStatus is a connected peer, from the client status.
+type peerStatus struct {
+	addr, client, pieces, flags, rate string
+}
+
+var (
+	connLineRegexp  = regexp.MustCompile(`^ ?\d+\. (.*)$`)
+	connStatsRegexp = regexp.MustCompile(`(\d+/\d+) completed, .* flags: ([^,]*), dr: ([0-9.]+ KiB/s)`)
+)
+
+// quotedPrefix returns the Go-quoted string at the start of s, including quotes.
+func quotedPrefix(s string) (string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", strconv.ErrSyntax
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return s[:i+1], nil
+		}
+	}
+	return "", strconv.ErrSyntax
+}
+
+// parseStatus returns the connected peers and the state of announces by tracker URL (next, last), from the status of a torrent as written by the torrent library.
+func parseStatus(s string) (peers []peerStatus, announces map[string][2]string) {
+	announces = map[string][2]string{}
+	lines := strings.Split(s, "\n")
+	inTrackers := false
+	for i, line := range lines {
+		if line == "Enabled trackers:" {
+			inTrackers = true
+			continue
+		}
+		if inTrackers {
+			if !strings.HasPrefix(line, "    ") {
+				inTrackers = false
+			} else if q, err := quotedPrefix(strings.TrimSpace(line)); err == nil {
+				url, _ := strconv.Unquote(q)
+				t := strings.SplitN(strings.TrimSpace(strings.TrimSpace(line)[len(q):]), "  ", 2)
+				if len(t) == 2 {
+					announces[url] = [2]string{t[0], strings.TrimSpace(t[1])}
+				}
+				continue
+			}
+		}
+
+		m := connLineRegexp.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		q, err := quotedPrefix(m[1])
+		if err != nil {
+			continue
+		}
+		f := strings.Fields(m[1][len(q):])
+		if len(f) == 0 {
+			continue
+		}
+		ps := peerStatus{addr: f[len(f)-1]}
+		if j := strings.Index(ps.addr, "-"); j >= 0 {
+			ps.addr = ps.addr[j+1:]
+		}
+		if id, err := strconv.Unquote(q); err == nil && len(id) >= 8 && id[0] == '-' && id[7] == '-' {
+			ps.client = id[1:7]
+		}
+		if i+2 < len(lines) {
+			if m := connStatsRegexp.FindStringSubmatch(lines[i+2]); m != nil {
+				ps.pieces, ps.flags, ps.rate = m[1], m[2], m[3]
+			}
+		}
+		peers = append(peers, ps)
+	}
+	return
+}
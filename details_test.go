@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// TestParseStatus parses the real status of a torrent with a tracker and a connected seeder.
+func TestParseStatus(t *testing.T) {
+	cleanup := newTestClient(t)
+	defer cleanup()
+	// the test client has trackers disabled
+	client.Close()
+	config.DisableTrackers = false
+	var err error
+	client, err = torrent.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateClient = client
+	defer func() {
+		privateClient = nil
+	}()
+
+	info, data := webSeedTorrent()
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := metainfo.HashBytes(infoBytes)
+
+	// the seeder has all data
+	seedDir, err := ioutil.TempDir("", "duittorrent-seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(seedDir)
+	writeTorrentData(t, seedDir, info, data)
+	seedConfig := torrent.NewDefaultClientConfig()
+	seedConfig.DataDir = seedDir
+	seedConfig.NoDHT = true
+	seedConfig.DisableTrackers = true
+	seedConfig.DisableIPv6 = true
+	seedConfig.ListenHost = config.ListenHost
+	seedConfig.Seed = true
+	seeder, err := torrent.NewClient(seedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	st, _, err := seeder.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: h, InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-st.GotInfo()
+	st.VerifyData()
+	seedAddr := fmt.Sprintf("127.0.0.1:%d", seeder.LocalPort())
+
+	// the tracker returns the seeder
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer := make([]byte, 6)
+		copy(peer, net.ParseIP("127.0.0.1").To4())
+		binary.BigEndian.PutUint16(peer[4:], uint16(seeder.LocalPort()))
+		buf, err := bencode.Marshal(map[string]interface{}{"interval": 1800, "peers": string(peer)})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf)
+	}))
+	defer tracker.Close()
+	trackerURL := tracker.URL + "/announce"
+
+	tor, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: h, InfoBytes: infoBytes, Trackers: [][]string{{trackerURL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tor.GotInfo()
+	tor.DownloadAll()
+
+	var status string
+	var peers []peerStatus
+	var announces map[string][2]string
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		status = clientStatus(tor)
+		peers, announces = parseStatus(status)
+		if len(peers) == 1 && peers[0].pieces == "3/3" && announces[trackerURL][1] == "1 peers" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no connected seeder and announce, got peers %v, announces %v, status:\n%s", peers, announces, status)
+		}
+	}
+
+	p := peers[0]
+	if p.addr != seedAddr || p.client != "GT0002" || p.flags == "" || p.rate == "" {
+		t.Fatalf("got peer %+v, expected addr %s and client GT0002, status:\n%s", p, seedAddr, status)
+	}
+	if len(announces) != 1 || announces[trackerURL][0] == "" {
+		t.Fatalf("got announces %v, expected next announce for %s, status:\n%s", announces, trackerURL, status)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net"
+	"os"
+
+	"github.com/anacrolix/dht"
+	"github.com/anacrolix/dht/krpc"
+	"github.com/mjl-/duit"
+)
+
+// The DHT routing table is saved on exit and periodically, and used for bootstrapping at the next start.
+
+func dhtNodesPath() string {
+	return appDataDir() + "/dht-nodes.dat"
+}
+
+// dhtStartingNodes returns a function for the client config that returns the saved nodes and the bootstrap nodes.
+// The bootstrap nodes are those from the settings, or the public ones if none are configured.
+func dhtStartingNodes() dht.StartingNodesGetter {
+	bootstrap := append([]string{}, settings.DHTBootstrapNodes...)
+	return func() ([]dht.Addr, error) {
+		var addrs []dht.Addr
+		nodes, err := dht.ReadNodesFromFile(dhtNodesPath())
+		if err != nil && !os.IsNotExist(err) {
+			logWarnf(nil, "reading saved dht nodes: %s", err)
+		}
+		for _, n := range nodes {
+			addrs = append(addrs, dht.NewAddr(n.Addr.UDP()))
+		}
+		if len(bootstrap) == 0 {
+			l, err := dht.GlobalBootstrapAddrs()
+			if len(addrs) == 0 && err != nil {
+				return nil, err
+			}
+			return append(addrs, l...), nil
+		}
+		for _, s := range bootstrap {
+			ua, err := net.ResolveUDPAddr("udp", s)
+			if err != nil {
+				logWarnf(nil, "dht bootstrap node %q: %s", s, err)
+				continue
+			}
+			addrs = append(addrs, dht.NewAddr(ua))
+		}
+		return addrs, nil
+	}
+}
+
+// saveDHTNodes writes the nodes in the routing tables of the client.
+// Nothing is written if the tables are empty, eg with DHT disabled, to keep the nodes of a previous session.
+func saveDHTNodes() {
+	var nodes []krpc.NodeInfo
+	for _, s := range client.DhtServers() {
+		nodes = append(nodes, s.Nodes()...)
+	}
+	if len(nodes) == 0 {
+		return
+	}
+	os.MkdirAll(appDataDir(), 0777)
+	if err := dht.WriteNodesToFile(nodes, dhtNodesPath()+".tmp"); err != nil {
+		logErrorf(nil, "saving dht nodes: %s", err)
+		return
+	}
+	if err := os.Rename(dhtNodesPath()+".tmp", dhtNodesPath()); err != nil {
+		logErrorf(nil, "saving dht nodes: %s", err)
+	}
+}
+
+// addDHTNode adds the node at host:port to the routing tables of the client.
+func addDHTNode(s string) error {
+	if len(client.DhtServers()) == 0 {
+		return fmt.Errorf("dht is disabled")
+	}
+	ua, err := net.ResolveUDPAddr("udp", s)
+	if err != nil {
+		return err
+	}
+	client.AddDHTNodes([]string{ua.String()})
+	logInfof(nil, "added dht node %s", ua)
+	return nil
+}
+
+// dhtNodesUI returns the UI for the network view that shows the number of DHT nodes and adds nodes.
+// The returned function updates the counts.
+func dhtNodesUI() (duit.UI, func()) {
+	count := &duit.Label{}
+	update := func() {
+		var nodes, good int
+		for _, s := range client.DhtServers() {
+			st := s.Stats()
+			nodes += st.Nodes
+			good += st.GoodNodes
+		}
+		text := fmt.Sprintf("DHT nodes: %d, good: %d", nodes, good)
+		if text != count.Text {
+			count.Text = text
+			dui.MarkLayout(nil)
+		}
+	}
+	update()
+
+	status := &duit.Label{}
+	node := &duit.Field{Placeholder: "host:port"}
+	add := &duit.Button{
+		Text: "add DHT node",
+		Click: func() (e duit.Event) {
+			dui.MarkLayout(nil)
+			if err := addDHTNode(node.Text); err != nil {
+				status.Text = err.Error()
+				return
+			}
+			status.Text = "added"
+			node.Text = ""
+			return
+		},
+	}
+	return &duit.Box{
+		Margin: image.Pt(6, 4),
+		Kids: duit.NewKids(
+			count,
+			&duit.Box{Width: 200, Kids: duit.NewKids(node)},
+			add,
+			status,
+		),
+	}, update
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// clientStatus returns the status as written by the torrent library.
+// For a torrent, only its section of the client status is returned.
+func clientStatus(t *torrent.Torrent) string {
+	b := &bytes.Buffer{}
+	if t == nil {
+		client.WriteStatus(b)
+		fmt.Fprintf(b, "\nClient for private torrents, without DHT and PEX:\n")
+		privateClient.WriteStatus(b)
+		return b.String()
+	}
+	torrentClient(t).WriteStatus(b)
+
+	// each torrent starts with its name and progress, followed by "Infohash: ..."
+	lines := strings.Split(b.String(), "\n")
+	start := -1
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "Infohash: ") || i < 2 {
+			continue
+		}
+		if start >= 0 {
+			return strings.Join(lines[start:i-2], "\n") + "\n"
+		}
+		if line == "Infohash: "+t.InfoHash().HexString() {
+			start = i - 2
+		}
+	}
+	if start < 0 {
+		return "torrent not found in client status\n"
+	}
+	return strings.Join(lines[start:], "\n")
+}
+
+const redacted = "(redacted)"
+
+// redactURL returns s without user info, path and query, they often hold credentials or passkeys.
+func redactURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redacted
+	}
+	r := u.Scheme + "://" + u.Host
+	if u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		r += "/" + redacted
+	}
+	return r
+}
+
+var urlRegexp = regexp.MustCompile(`magnet:\?[^\s"'<>]+|[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// redactMagnet returns magnet link s with the URLs in its parameters redacted: trackers, web seeds and sources.
+func redactMagnet(s string) string {
+	params := strings.Split(strings.TrimPrefix(s, "magnet:?"), "&")
+	for i, p := range params {
+		t := strings.SplitN(p, "=", 2)
+		if len(t) != 2 {
+			continue
+		}
+		switch t[0] {
+		case "tr", "ws", "as", "xs":
+			v, err := url.QueryUnescape(t[1])
+			if err != nil || v == "" {
+				params[i] = t[0] + "=" + redacted
+			} else {
+				params[i] = t[0] + "=" + redactURL(v)
+			}
+		}
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// redactURLs redacts all URLs in text, eg tracker URLs in the client status, and URLs in magnet links.
+func redactURLs(text string) string {
+	return urlRegexp.ReplaceAllStringFunc(text, func(s string) string {
+		if strings.HasPrefix(s, "magnet:") {
+			return redactMagnet(s)
+		}
+		return redactURL(s)
+	})
+}
+
+// redactSettings returns a copy of s without hook commands, and with URLs redacted.
+func redactSettings(s Settings) Settings {
+	hooks := map[string]string{}
+	for k := range s.Hooks {
+		hooks[k] = redacted
+	}
+	s.Hooks = hooks
+	feeds := append([]Feed{}, s.Feeds...)
+	for i := range feeds {
+		feeds[i].URL = redactURL(feeds[i].URL)
+	}
+	s.Feeds = feeds
+	blocklists := append([]string{}, s.Blocklists...)
+	for i, b := range blocklists {
+		if isURL(b) {
+			blocklists[i] = redactURL(b)
+		}
+	}
+	s.Blocklists = blocklists
+	trackers := append([]string{}, s.DefaultTrackers...)
+	for i := range trackers {
+		trackers[i] = redactURL(trackers[i])
+	}
+	s.DefaultTrackers = trackers
+	s.Network.ProxyURL = redactURL(s.Network.ProxyURL)
+	return s
+}
+
+// writeDebugBundle writes a zip file with the status of the client, the settings, client config and recent log to path.
+// Hook commands, credentials and URLs, which can hold passkeys, are redacted.
+func writeDebugBundle(path string) error {
+	b := &bytes.Buffer{}
+	z := zip.NewWriter(b)
+	add := func(name string, data []byte) error {
+		w, err := z.Create(name)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		return err
+	}
+	settingsBuf, err := json.MarshalIndent(redactSettings(settings), "", "\t")
+	if err != nil {
+		return err
+	}
+	cfg := *config
+	cfg.ProxyURL = redactURL(cfg.ProxyURL)
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"status.txt", []byte(redactURLs(clientStatus(nil)))},
+		{"settings.json", settingsBuf},
+		{"config.txt", []byte(redactURLs(fmt.Sprintf("%+v\n", cfg)))},
+		{"log.txt", []byte(redactURLs(logText()))},
+	}
+	for _, f := range files {
+		if err := add(f.name, f.data); err != nil {
+			return err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return err
+	}
+	os.MkdirAll(appDataDir(), 0777)
+	return ioutil.WriteFile(path, b.Bytes(), 0666)
+}
+
+// diagnosticsView returns the UI showing the status of the client or a torrent.
+func diagnosticsView() duit.UI {
+	var target metainfo.Hash // zero for whole client
+	rows := []*duit.Gridrow{{Selected: true, Values: []string{"client"}}}
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		rows = append(rows, &duit.Gridrow{Values: []string{t.Name()}, Value: t})
+	}
+
+	text := &duit.Label{}
+	status := &duit.Label{}
+	refresh := func() {
+		var t *torrent.Torrent
+		if target != (metainfo.Hash{}) {
+			if row := findRowHash(target); row != nil {
+				t = row.Value.(*torrent.Torrent)
+			}
+		}
+		text.Text = clientStatus(t)
+		dui.MarkLayout(nil)
+	}
+	refresh()
+
+	auto := &duit.Checkbox{Checked: true}
+	nextViewTick = func() {
+		if auto.Checked {
+			refresh()
+		}
+	}
+
+	targets := &duit.Gridlist{
+		Rows:    rows,
+		Padding: duit.SpaceXY(2, 2),
+		Changed: func(index int) (e duit.Event) {
+			target = metainfo.Hash{}
+			if row := rows[index]; row.Selected && row.Value != nil {
+				target = row.Value.(*torrent.Torrent).InfoHash()
+			}
+			refresh()
+			return
+		},
+	}
+
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(0, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: "Diagnostics", Font: bold},
+			&duit.Scroll{Height: 100, Kid: duit.Kid{UI: targets}},
+			&duit.Box{
+				Margin: image.Pt(6, 0),
+				Kids: duit.NewKids(
+					auto,
+					&duit.Label{Text: "auto refresh"},
+					&duit.Button{
+						Text: "refresh",
+						Click: func() (e duit.Event) {
+							refresh()
+							return
+						},
+					},
+					&duit.Button{
+						Text: "copy",
+						Click: func() (e duit.Event) {
+							dui.WriteSnarf([]byte(text.Text))
+							status.Text = "copied"
+							return
+						},
+					},
+					&duit.Button{
+						Text: "save debug bundle",
+						Click: func() (e duit.Event) {
+							path := appDataDir() + "/debug-" + time.Now().Format("20060102-150405") + ".zip"
+							if err := writeDebugBundle(path); err != nil {
+								status.Text = "saving debug bundle: " + err.Error()
+							} else {
+								status.Text = "saved " + path
+							}
+							dui.MarkLayout(nil)
+							return
+						},
+					},
+					&duit.Button{
+						Text: "close",
+						Click: func() (e duit.Event) {
+							showMain()
+							return
+						},
+					},
+					status,
+				),
+			},
+			&duit.Scroll{Height: -1, Kid: duit.Kid{UI: text}},
+		),
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactURLs(t *testing.T) {
+	for _, c := range []struct {
+		text, expect string
+	}{
+		{
+			"tracker http://tracker.example/announce?passkey=secret ok",
+			"tracker http://tracker.example/(redacted) ok",
+		},
+		{
+			"added magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=a+b&tr=https%3A%2F%2Ftracker.example%2Fsecret%2Fannounce&ws=http%3A%2F%2Fuser%3Apass%40seed.example%2F&tr=udp%3A%2F%2Fopen.example%3A1337 done",
+			"added magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=a+b&tr=https://tracker.example/(redacted)&ws=http://seed.example/(redacted)&tr=udp://open.example:1337 done",
+		},
+		{"magnet:?tr=%zz", "magnet:?tr=" + redacted},
+	} {
+		s := redactURLs(c.text)
+		if s != c.expect {
+			t.Errorf("redacting %q:\ngot      %q\nexpected %q", c.text, s, c.expect)
+		}
+		if strings.Contains(s, "secret") || strings.Contains(s, "pass") {
+			t.Errorf("credentials left in %q", s)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = []string{"debug", "info", "warning", "error"}
+
+// logEntry is a message in the event log, optionally about a torrent.
+type logEntry struct {
+	time  time.Time
+	level logLevel
+	hash  metainfo.Hash
+	name  string // of the torrent, empty if not about a torrent
+	text  string
+}
+
+func (e logEntry) String() string {
+	s := e.time.Format("2006-01-02 15:04:05") + " " + logLevels[e.level] + " "
+	if e.name != "" {
+		s += e.name + ": "
+	}
+	return s + e.text
+}
+
+const (
+	logKeep         = 1000    // entries kept in memory
+	logFileMaxSize  = 1 << 20 // log file is rotated when it would become bigger
+	logFileRotated  = 3       // number of old log files kept
+	logBannerPeriod = 10 * time.Second
+)
+
+// eventLog keeps the most recent entries for the log view, and writes all entries to stderr and the log file.
+// Entries are added from any goroutine.
+var eventLog struct {
+	sync.Mutex
+	entries   []logEntry
+	seq       int // number of entries logged, for noticing changes
+	lastError logEntry
+	file      *os.File
+	fileSize  int64
+}
+
+func logDebugf(t *torrent.Torrent, format string, args ...interface{}) {
+	logf(levelDebug, t, format, args...)
+}
+
+func logInfof(t *torrent.Torrent, format string, args ...interface{}) {
+	logf(levelInfo, t, format, args...)
+}
+
+func logWarnf(t *torrent.Torrent, format string, args ...interface{}) {
+	logf(levelWarn, t, format, args...)
+}
+
+func logErrorf(t *torrent.Torrent, format string, args ...interface{}) {
+	logf(levelError, t, format, args...)
+}
+
+func logf(level logLevel, t *torrent.Torrent, format string, args ...interface{}) {
+	e := logEntry{time: time.Now(), level: level, text: strings.TrimRight(fmt.Sprintf(format, args...), "\n")}
+	if t != nil {
+		e.hash = t.InfoHash()
+		e.name = t.Name()
+	}
+	addLog(e)
+}
+
+func addLog(e logEntry) {
+	line := e.String() + "\n"
+	os.Stderr.WriteString(line)
+
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	eventLog.entries = append(eventLog.entries, e)
+	if len(eventLog.entries) > logKeep {
+		eventLog.entries = append([]logEntry{}, eventLog.entries[len(eventLog.entries)-logKeep:]...)
+	}
+	eventLog.seq++
+	if e.level == levelError {
+		eventLog.lastError = e
+	}
+	writeLogFile(line)
+}
+
+// stdLog receives output of the standard log package, eg from libraries, as info entries.
+type stdLog struct{}
+
+func (stdLog) Write(buf []byte) (int, error) {
+	for _, s := range strings.Split(strings.TrimRight(string(buf), "\n"), "\n") {
+		addLog(logEntry{time: time.Now(), level: levelInfo, text: s})
+	}
+	return len(buf), nil
+}
+
+func logFilePath() string {
+	return appDataDir() + "/duittorrent.log"
+}
+
+func openLogFile() {
+	os.MkdirAll(appDataDir(), 0777)
+	f, err := os.OpenFile(logFilePath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err == nil {
+		var fi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			eventLog.Lock()
+			eventLog.file = f
+			eventLog.fileSize = fi.Size()
+			eventLog.Unlock()
+			return
+		}
+		f.Close()
+	}
+	logErrorf(nil, "opening log file: %s", err)
+}
+
+// writeLogFile writes line to the log file, rotating it when too big.
+// Must be called with eventLog locked.
+func writeLogFile(line string) {
+	if eventLog.file == nil {
+		return
+	}
+	if eventLog.fileSize+int64(len(line)) > logFileMaxSize {
+		eventLog.file.Close()
+		eventLog.file = nil
+		p := logFilePath()
+		for i := logFileRotated - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", p, i), fmt.Sprintf("%s.%d", p, i+1))
+		}
+		os.Rename(p, p+".1")
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rotating log file: %s\n", err)
+			return
+		}
+		eventLog.file = f
+		eventLog.fileSize = 0
+	}
+	n, err := eventLog.file.WriteString(line)
+	eventLog.fileSize += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "writing log file: %s, no longer writing to log file\n", err)
+		eventLog.file.Close()
+		eventLog.file = nil
+	}
+}
+
+func closeLogFile() {
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	if eventLog.file != nil {
+		eventLog.file.Close()
+		eventLog.file = nil
+	}
+}
+
+// logText returns the entries in memory as text.
+func logText() string {
+	eventLog.Lock()
+	defer eventLog.Unlock()
+	var b strings.Builder
+	for _, e := range eventLog.entries {
+		b.WriteString(e.String() + "\n")
+	}
+	return b.String()
+}
+
+// updateLogBanner shows the most recent error in the bar, for a short while.
+func updateLogBanner() {
+	eventLog.Lock()
+	e := eventLog.lastError
+	eventLog.Unlock()
+	text := ""
+	if !e.time.IsZero() && time.Since(e.time) < logBannerPeriod {
+		text = "error: "
+		if e.name != "" {
+			text += e.name + ": "
+		}
+		text += e.text
+	}
+	if text != logBanner.Text {
+		logBanner.Text = text
+		dui.MarkLayout(nil)
+	}
+}
+
+// logView returns the UI showing the event log, filtered by level, text and optionally the selected torrents.
+func logView() duit.UI {
+	sel := map[metainfo.Hash]bool{}
+	for _, t := range selectedTorrents() {
+		sel[t.InfoHash()] = true
+	}
+	level := &duit.Buttongroup{Texts: logLevels, Selected: int(levelInfo)}
+	text := &duit.Field{Placeholder: "filter..."}
+	onlySelected := &duit.Checkbox{Disabled: len(sel) == 0}
+	entries := &duit.Gridlist{
+		Header:  &duit.Gridrow{Values: []string{"time", "level", "torrent", "message"}},
+		Padding: duit.SpaceXY(2, 2),
+		Striped: true,
+	}
+
+	seq := -1
+	update := func(force bool) {
+		eventLog.Lock()
+		if !force && seq == eventLog.seq {
+			eventLog.Unlock()
+			return
+		}
+		seq = eventLog.seq
+		l := append([]logEntry{}, eventLog.entries...)
+		eventLog.Unlock()
+
+		var rows []*duit.Gridrow
+		s := strings.ToLower(text.Text)
+		for i := len(l) - 1; i >= 0; i-- {
+			e := l[i]
+			if e.level < logLevel(level.Selected) || onlySelected.Checked && len(sel) > 0 && !sel[e.hash] {
+				continue
+			}
+			if s != "" && !strings.Contains(strings.ToLower(e.name+" "+e.text), s) {
+				continue
+			}
+			rows = append(rows, &duit.Gridrow{Values: []string{e.time.Format("2006-01-02 15:04:05"), logLevels[e.level], e.name, e.text}})
+		}
+		entries.Rows = rows
+		dui.MarkLayout(nil)
+	}
+	text.Changed = func(string) (e duit.Event) {
+		update(true)
+		return
+	}
+	level.Changed = func(int) (e duit.Event) {
+		update(true)
+		return
+	}
+	onlySelected.Changed = func() (e duit.Event) {
+		update(true)
+		return
+	}
+	update(true)
+	nextViewTick = func() {
+		update(false)
+	}
+
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(0, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: "Log", Font: bold},
+			&duit.Box{
+				Margin: image.Pt(6, 0),
+				Kids: duit.NewKids(
+					level,
+					&duit.Box{Width: 200, Kids: duit.NewKids(text)},
+					onlySelected,
+					&duit.Label{Text: "selected torrents only"},
+					&duit.Button{
+						Text: "close",
+						Click: func() (e duit.Event) {
+							showMain()
+							return
+						},
+					},
+				),
+			},
+			&duit.Scroll{Height: -1, Kid: duit.Kid{UI: entries}},
+		),
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Feed is an RSS 2.0 or Atom feed that is polled for new torrents.
+// Items are added if their title matches any Include regexp (or Include is empty), and none of the Exclude regexps.
+type Feed struct {
+	URL         string
+	Interval    int      // In minutes, default 30.
+	Include     []string // Regular expressions, matched against the item title.
+	Exclude     []string
+	DownloadDir string // Optional.
+	Label       string // Optional.
+	Paused      bool   // Add torrents paused.
+}
+
+// feedItem is an item from a feed with a magnet or .torrent link.
+type feedItem struct {
+	ID    string // guid, id, or link if absent
+	Title string
+	Link  string // magnet URI or URL of a .torrent file
+}
+
+var (
+	feedSeen     map[string]time.Time // "feed-url item-id" to when it was last in the feed, or added
+	feedSeenPath string
+	feedFetching = map[string]bool{} // keys of items whose .torrent file is being fetched
+	feedHTTP     = &http.Client{Timeout: time.Minute}
+)
+
+// fetchError is a failure to fetch a .torrent file that may be temporary, the item is tried again at the next poll.
+type fetchError struct {
+	err error
+}
+
+func (e fetchError) Error() string {
+	return e.err.Error()
+}
+
+const feedSeenExpire = 90 * 24 * time.Hour // items not in their feed for this long are forgotten
+
+// startFeeds starts polling all feeds in the background.
+func startFeeds() {
+	feedSeenPath = appDataDir() + "/feeds-seen.json"
+	feedSeen = map[string]time.Time{}
+	buf, err := ioutil.ReadFile(feedSeenPath)
+	if err == nil {
+		err = json.Unmarshal(buf, &feedSeen)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf(nil, "reading seen feed items: %s", err)
+	}
+
+	for _, f := range settings.Feeds {
+		include, err := compileRegexps(f.Include)
+		if err != nil {
+			logErrorf(nil, "feed %s: include: %s, not polling feed", f.URL, err)
+			continue
+		}
+		exclude, err := compileRegexps(f.Exclude)
+		if err != nil {
+			logErrorf(nil, "feed %s: exclude: %s, not polling feed", f.URL, err)
+			continue
+		}
+		go pollFeed(f, include, exclude)
+	}
+}
+
+func compileRegexps(l []string) ([]*regexp.Regexp, error) {
+	var r []*regexp.Regexp
+	for _, s := range l {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, re)
+	}
+	return r, nil
+}
+
+func feedMatch(title string, include, exclude []*regexp.Regexp) bool {
+	for _, re := range exclude {
+		if re.MatchString(title) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, re := range include {
+		if re.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+func pollFeed(f Feed, include, exclude []*regexp.Regexp) {
+	interval := time.Duration(f.Interval) * time.Minute
+	if interval <= 0 {
+		interval = 30 * time.Minute
+	}
+	for {
+		items, err := fetchFeed(f.URL)
+		if err != nil {
+			logErrorf(nil, "feed %s: %s", f.URL, err)
+		} else {
+			dui.Call <- func() {
+				feedItems(f, include, exclude, items)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// feedItems adds the new matching items. Called from the main loop.
+func feedItems(f Feed, include, exclude []*regexp.Regexp, items []feedItem) {
+	opts := addOpts{Dir: f.DownloadDir, Label: f.Label, Paused: f.Paused}
+	for _, item := range items {
+		key := f.URL + " " + item.ID
+		if _, ok := feedSeen[key]; ok {
+			// still in the feed, keep it from expiring
+			feedSeen[key] = time.Now()
+			continue
+		}
+		if feedFetching[key] || !feedMatch(item.Title, include, exclude) {
+			continue
+		}
+		if strings.HasPrefix(item.Link, "magnet:") {
+			spec, err := torrent.TorrentSpecFromMagnetURI(item.Link)
+			o := opts
+			o.WebSeeds = magnetWebSeeds(item.Link)
+			feedAdd(key, o, spec, err)
+			continue
+		}
+		// don't fetch again while the fetch is in progress
+		feedFetching[key] = true
+		go func(link string) {
+			spec, ws, err := fetchTorrentFile(link)
+			dui.Call <- func() {
+				o := opts
+				o.WebSeeds = ws
+				feedAdd(key, o, spec, err)
+			}
+		}(item.Link)
+	}
+	saveFeedSeen()
+}
+
+func feedAdd(key string, opts addOpts, spec *torrent.TorrentSpec, err error) {
+	delete(feedFetching, key)
+	if _, ok := err.(fetchError); ok {
+		logWarnf(nil, "feed item %s: %s, trying again at next poll", key, err)
+		return
+	}
+	if err == nil {
+		_, err = addTorrent(spec, opts)
+	}
+	if err != nil {
+		logErrorf(nil, "feed item %s: %s", key, err)
+		runHook("error", nil, fmt.Errorf("feed item %s: %s", key, err))
+	}
+	// also when adding failed, no point in retrying a bad item, or a duplicate, forever
+	feedSeen[key] = time.Now()
+	saveFeedSeen()
+}
+
+func saveFeedSeen() {
+	for k, tm := range feedSeen {
+		if time.Since(tm) > feedSeenExpire {
+			delete(feedSeen, k)
+		}
+	}
+	buf, err := json.Marshal(feedSeen)
+	if err == nil {
+		os.MkdirAll(filepath.Dir(feedSeenPath), 0777)
+		err = ioutil.WriteFile(feedSeenPath, buf, 0666)
+	}
+	if err != nil {
+		logErrorf(nil, "saving seen feed items: %s", err)
+	}
+}
+
+// fetchTorrentFile returns the spec and web seeds of the torrent file at url.
+func fetchTorrentFile(url string) (*torrent.TorrentSpec, []string, error) {
+	resp, err := feedHTTP.Get(url)
+	if err != nil {
+		return nil, nil, fetchError{err}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, nil, fetchError{fmt.Errorf("fetching torrent file: %s", resp.Status)}
+	default:
+		return nil, nil, fmt.Errorf("fetching torrent file: %s", resp.Status)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fetchError{err}
+	}
+	mi, err := metainfo.Load(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := mi.UnmarshalInfo(); err != nil {
+		return nil, nil, err
+	}
+	return torrent.TorrentSpecFromMetaInfo(mi), mi.UrlList, nil
+}
+
+func fetchFeed(url string) ([]feedItem, error) {
+	resp, err := feedHTTP.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching feed: %s", resp.Status)
+	}
+	return parseFeed(resp.Body)
+}
+
+// parseFeed parses an RSS 2.0 or Atom feed, returning only items that link to a magnet URI or torrent file.
+func parseFeed(r io.Reader) ([]feedItem, error) {
+	type link struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+	}
+	type enclosure struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	}
+	var doc struct {
+		XMLName xml.Name
+		// rss
+		Items []struct {
+			Title     string      `xml:"title"`
+			Link      string      `xml:"link"`
+			GUID      string      `xml:"guid"`
+			Enclosure []enclosure `xml:"enclosure"`
+		} `xml:"channel>item"`
+		// atom
+		Entries []struct {
+			Title string `xml:"title"`
+			ID    string `xml:"id"`
+			Links []link `xml:"link"`
+		} `xml:"entry"`
+	}
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	isTorrent := func(url, typ string) bool {
+		return strings.HasPrefix(url, "magnet:") || typ == "application/x-bittorrent" || strings.HasSuffix(strings.SplitN(url, "?", 2)[0], ".torrent")
+	}
+
+	var items []feedItem
+	add := func(id, title, link string) {
+		if id == "" {
+			id = link
+		}
+		items = append(items, feedItem{id, strings.TrimSpace(title), link})
+	}
+	switch doc.XMLName.Local {
+	case "rss":
+		for _, it := range doc.Items {
+			link := ""
+			for _, e := range it.Enclosure {
+				if isTorrent(e.URL, e.Type) {
+					link = e.URL
+					break
+				}
+			}
+			if link == "" && isTorrent(it.Link, "") {
+				link = it.Link
+			}
+			if link != "" {
+				add(it.GUID, it.Title, link)
+			}
+		}
+	case "feed":
+		for _, e := range doc.Entries {
+			for _, l := range e.Links {
+				if (l.Rel == "" || l.Rel == "enclosure" || l.Rel == "alternate") && isTorrent(l.Href, l.Type) {
+					add(e.ID, e.Title, l.Href)
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unrecognized feed type %q", doc.XMLName.Local)
+	}
+	return items, nil
+}
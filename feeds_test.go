@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// feedServer serves the fixture feeds from testdata, and a torrent file at /files/.
+func feedServer(t *testing.T) *httptest.Server {
+	info := metainfo.Info{Name: "one", PieceLength: 16 * 1024, Length: 3, Pieces: make([]byte, 20)}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile, err := bencode.Marshal(metainfo.MetaInfo{InfoBytes: infoBytes, UrlList: []string{"http://example.com/one"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/files/"):
+			w.Write(torrentFile)
+		case r.URL.Path == "/feed.rss" || r.URL.Path == "/feed.atom":
+			buf, err := ioutil.ReadFile(filepath.Join("testdata", r.URL.Path))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(strings.Replace(string(buf), "http://feeds.test", srv.URL, -1)))
+		case r.URL.Path == "/unavailable":
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func TestFetchFeed(t *testing.T) {
+	srv := feedServer(t)
+	defer srv.Close()
+
+	items, err := fetchFeed(srv.URL + "/feed.rss")
+	if err != nil {
+		t.Fatalf("rss: %s", err)
+	}
+	expect := []feedItem{
+		{"item-1", "Linux ISO 1.0", srv.URL + "/files/one.torrent"},
+		{"item-2", "Linux ISO 1.0 beta", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=beta&ws=http%3A%2F%2Fexample.com%2Fbeta"},
+	}
+	if !reflect.DeepEqual(items, expect) {
+		t.Fatalf("rss: got %v, expected %v", items, expect)
+	}
+
+	items, err = fetchFeed(srv.URL + "/feed.atom")
+	if err != nil {
+		t.Fatalf("atom: %s", err)
+	}
+	expect = []feedItem{
+		{"urn:dataset:2", "Dataset 2", srv.URL + "/files/two"},
+		{"magnet:?xt=urn:btih:89abcdef0123456789abcdef0123456789abcdef", "Dataset 3", "magnet:?xt=urn:btih:89abcdef0123456789abcdef0123456789abcdef"},
+	}
+	if !reflect.DeepEqual(items, expect) {
+		t.Fatalf("atom: got %v, expected %v", items, expect)
+	}
+
+	if _, err := fetchFeed(srv.URL + "/missing"); err == nil {
+		t.Fatalf("missing feed: expected error")
+	}
+}
+
+func TestFetchTorrentFile(t *testing.T) {
+	srv := feedServer(t)
+	defer srv.Close()
+
+	spec, webSeeds, err := fetchTorrentFile(srv.URL + "/files/one.torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.DisplayName != "one" || !reflect.DeepEqual(webSeeds, []string{"http://example.com/one"}) {
+		t.Fatalf("got name %q, web seeds %v", spec.DisplayName, webSeeds)
+	}
+	if _, _, err := fetchTorrentFile(srv.URL + "/feed.rss"); err == nil {
+		t.Fatalf("feed as torrent file: expected error")
+	} else if _, ok := err.(fetchError); ok {
+		t.Fatalf("feed as torrent file: got temporary error %v, expected permanent", err)
+	}
+	if _, _, err := fetchTorrentFile(srv.URL + "/missing"); err == nil {
+		t.Fatalf("missing file: expected error")
+	} else if _, ok := err.(fetchError); ok {
+		t.Fatalf("missing file: got temporary error %v, expected permanent", err)
+	}
+	if _, _, err := fetchTorrentFile(srv.URL + "/unavailable"); err == nil {
+		t.Fatalf("unavailable: expected error")
+	} else if _, ok := err.(fetchError); !ok {
+		t.Fatalf("unavailable: got permanent error %v, expected temporary", err)
+	}
+}
+
+func TestFeedMatch(t *testing.T) {
+	include := []*regexp.Regexp{regexp.MustCompile(`^Linux ISO`)}
+	exclude := []*regexp.Regexp{regexp.MustCompile(`beta`)}
+	for _, c := range []struct {
+		title string
+		match bool
+	}{
+		{"Linux ISO 1.0", true},
+		{"Linux ISO 1.0 beta", false},
+		{"Release notes", false},
+	} {
+		if m := feedMatch(c.title, include, exclude); m != c.match {
+			t.Errorf("%q: got %v, expected %v", c.title, m, c.match)
+		}
+	}
+	if !feedMatch("anything", nil, nil) {
+		t.Errorf("empty include should match")
+	}
+}
+
+func TestFeedSeenExpire(t *testing.T) {
+	srv := feedServer(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "duittorrent-feeds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	feedSeenPath = filepath.Join(dir, "feeds-seen.json")
+
+	f := Feed{URL: srv.URL + "/feed.rss"}
+	items, err := fetchFeed(f.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * feedSeenExpire)
+	feedSeen = map[string]time.Time{}
+	for _, item := range items {
+		feedSeen[f.URL+" "+item.ID] = old
+	}
+	gone := f.URL + " item-0"
+	feedSeen[gone] = old
+
+	// all items were seen, so nothing is added
+	feedItems(f, nil, nil, items)
+
+	if _, ok := feedSeen[gone]; ok {
+		t.Errorf("item no longer in feed was not expired")
+	}
+	for _, item := range items {
+		if tm, ok := feedSeen[f.URL+" "+item.ID]; !ok || time.Since(tm) > time.Minute {
+			t.Errorf("item %s still in feed was expired or not refreshed", item.ID)
+		}
+	}
+	if _, err := os.Stat(feedSeenPath); err != nil {
+		t.Errorf("seen items not saved: %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// torrentFiles holds which files of a torrent are to be downloaded, by file index.
+// Absent for torrents of which all files are downloaded.
+var torrentFiles map[metainfo.Hash][]bool
+
+// fileWanted returns whether file index of the torrent is to be downloaded.
+func fileWanted(h metainfo.Hash, index int) bool {
+	sel, ok := torrentFiles[h]
+	return !ok || index < len(sel) && sel[index]
+}
+
+// setFileSelection sets which files of t are to be downloaded, nil for all, and updates the download if t is wanted.
+func setFileSelection(t *torrent.Torrent, sel []bool) {
+	h := t.InfoHash()
+	all := true
+	for _, v := range sel {
+		all = all && v
+	}
+	if all {
+		delete(torrentFiles, h)
+	} else {
+		torrentFiles[h] = sel
+	}
+	if torrentWant[h] && t.Info() != nil {
+		startDownload(t)
+	}
+}
+
+// startDownload requests the pieces of the wanted files of t.
+// The info of t must be present.
+func startDownload(t *torrent.Torrent) {
+	h := t.InfoHash()
+	if _, ok := torrentFiles[h]; !ok {
+		t.DownloadAll()
+		return
+	}
+	// priorities of pieces are at least those of their files, clear them first
+	t.CancelPieces(0, t.NumPieces())
+	for i, f := range t.Files() {
+		if fileWanted(h, i) {
+			f.Download()
+		} else {
+			f.SetPriority(torrent.PiecePriorityNone)
+		}
+	}
+}
+
+// stopDownload cancels all pieces of t.
+// The info of t must be present.
+func stopDownload(t *torrent.Torrent) {
+	for _, f := range t.Files() {
+		f.SetPriority(torrent.PiecePriorityNone)
+	}
+	t.CancelPieces(0, t.NumPieces())
+}
+
+// fileCompleted returns the bytes of f that have been downloaded and verified.
+func fileCompleted(f *torrent.File) int64 {
+	var n int64
+	for _, ps := range f.State() {
+		if ps.Complete {
+			n += ps.Bytes
+		}
+	}
+	return n
+}
+
+// bytesWantedMissing returns the bytes still to be downloaded for the wanted files of t.
+// The info of t must be present.
+func bytesWantedMissing(t *torrent.Torrent) int64 {
+	h := t.InfoHash()
+	if _, ok := torrentFiles[h]; !ok {
+		return t.BytesMissing()
+	}
+	var n int64
+	for i, f := range t.Files() {
+		if fileWanted(h, i) {
+			n += f.Length() - fileCompleted(f)
+		}
+	}
+	return n
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"errors"
+)
+
+// freeSpace returns the bytes available to us on the file system of path.
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -6,6 +6,7 @@ replace 9fans.net/go v0.0.0-00010101000000-000000000000 => github.com/mjl-/go v0
 
 require (
 	9fans.net/go v0.0.0-00010101000000-000000000000
+	github.com/anacrolix/dht v1.0.1
 	github.com/anacrolix/torrent v1.1.4
 	github.com/mjl-/duit v0.0.0-20190531054125-a1c247ae783d
 	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
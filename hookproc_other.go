@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import (
+	"os/exec"
+)
+
+// hookProcessGroup does nothing, process groups are not supported on this platform.
+func hookProcessGroup(cmd *exec.Cmd) {
+}
+
+// killHook kills the started cmd. Processes it started keep running.
+func killHook(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
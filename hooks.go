@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Events for which a hook command can be configured in Settings.Hooks.
+var hookEvents = []string{
+	"added",     // Torrent was added.
+	"gotinfo",   // Metainfo was received.
+	"completed", // All wanted data has been downloaded.
+	"seeded",    // Seeding goal was reached.
+	"removed",   // Torrent was removed.
+	"error",     // Something went wrong, see $DUITTORRENT_ERROR. Torrent details may be absent.
+}
+
+var (
+	torrentCompleted map[metainfo.Hash]bool // whether "completed" has been fired
+	torrentSeeded    map[metainfo.Hash]bool // whether "seeded" has been fired
+
+	torrentCompletedAt map[metainfo.Hash]time.Time
+
+	hookLogSeq int // event log entries up to this sequence number have been checked for torrent errors
+)
+
+const hookKillWait = 5 * time.Second // for output after killing a hook at its timeout
+
+// runHook starts the command configured for event, if any, in the background.
+// t can be nil, eg when adding a torrent failed.
+// Variables describing the torrent are passed through the environment.
+func runHook(event string, t *torrent.Torrent, err error) {
+	command := settings.Hooks[event]
+	if command == "" {
+		return
+	}
+
+	env := append(os.Environ(), "DUITTORRENT_EVENT="+event)
+	if err != nil {
+		env = append(env, "DUITTORRENT_ERROR="+err.Error())
+	}
+	if t != nil {
+		dir := savePath(t)
+		env = append(env,
+			"DUITTORRENT_INFOHASH="+t.InfoHash().HexString(),
+			"DUITTORRENT_NAME="+t.Name(),
+			"DUITTORRENT_SAVEPATH="+dir,
+		)
+		if t.Info() != nil {
+			// one file per line, size and path separated by a tab
+			var files []string
+			for _, f := range t.Files() {
+				files = append(files, fmt.Sprintf("%d\t%s", f.Length(), filepath.Join(dir, filepath.FromSlash(f.Path()))))
+			}
+			env = append(env,
+				fmt.Sprintf("DUITTORRENT_SIZE=%d", t.Length()),
+				"DUITTORRENT_FILES="+strings.Join(files, "\n"),
+			)
+		}
+	}
+
+	timeout := time.Duration(settings.HookTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 60 * time.Second
+	}
+
+	go func() {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = env
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		hookProcessGroup(cmd)
+		start := time.Now()
+		output := func() string { return out.String() }
+		err := cmd.Start()
+		if err == nil {
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+			select {
+			case err = <-done:
+			case <-time.After(timeout):
+				// kill the whole group, children holding the output pipe would keep Wait from returning
+				killHook(cmd)
+				select {
+				case <-done:
+				case <-time.After(hookKillWait):
+					// output is still being written to
+					output = func() string { return "(unavailable, output still open)" }
+				}
+				err = fmt.Errorf("timeout after %s", timeout)
+			}
+		}
+		level := levelInfo
+		status := "ok"
+		if err != nil {
+			level = levelError
+			if event == "error" {
+				// an error would fire this hook again
+				level = levelWarn
+			}
+			status = err.Error()
+		}
+		logf(level, t, "hook %s: %s, in %s, output: %q", event, status, time.Since(start).Round(time.Millisecond), output())
+	}()
+}
+
+// checkErrorHooks fires the "error" event for the errors logged about torrents since the previous call.
+// Errors are logged from any goroutine, hooks are started from the main loop. Called each tick.
+func checkErrorHooks() {
+	eventLog.Lock()
+	n := eventLog.seq - hookLogSeq
+	if n > len(eventLog.entries) {
+		n = len(eventLog.entries)
+	}
+	l := append([]logEntry{}, eventLog.entries[len(eventLog.entries)-n:]...)
+	hookLogSeq = eventLog.seq
+	eventLog.Unlock()
+
+	for _, e := range l {
+		if e.level != levelError || e.name == "" {
+			continue
+		}
+		if row := findRowHash(e.hash); row != nil {
+			runHook("error", row.Value.(*torrent.Torrent), errors.New(e.text))
+		}
+	}
+}
+
+// checkHooks fires the "completed" and "seeded" events when t reaches those states.
+// Called periodically.
+func checkHooks(t *torrent.Torrent) {
+	h := t.InfoHash()
+	if t.Info() == nil || !torrentWant[h] || bytesWantedMissing(t) != 0 {
+		return
+	}
+	if !torrentCompleted[h] {
+		torrentCompleted[h] = true
+		torrentCompletedAt[h] = time.Now()
+		runHook("completed", t, nil)
+	}
+	goal := seedRatio(h)
+	if goal <= 0 || torrentSeeded[h] || t.Length() == 0 {
+		return
+	}
+	if shareRatio(t) >= goal {
+		torrentSeeded[h] = true
+		runHook("seeded", t, nil)
+	}
+}
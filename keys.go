@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/mjl-/duit"
+)
+
+// keyActions are the actions that can be bound to keys, in the order shown in the help view.
+var keyActions = []struct {
+	name, help string
+}{
+	{"up", "select previous torrent"},
+	{"down", "select next torrent"},
+	{"toggle", "start or pause selected torrents"},
+	{"remove", "remove selected torrents, after confirmation"},
+	{"verify", "verify data of selected torrents"},
+	{"search", "focus search field"},
+	{"paste", "add magnet link or torrent file from snarf buffer"},
+	{"help", "show key bindings"},
+	{"close", "close view, back to torrent list"},
+}
+
+var defaultKeys = map[string]string{
+	"up":     "up",
+	"k":      "up",
+	"down":   "down",
+	"j":      "down",
+	"space":  "toggle",
+	"delete": "remove",
+	"v":      "verify",
+	"/":      "search",
+	"ctrl-v": "paste",
+	"?":      "help",
+	"escape": "close",
+}
+
+var keyNames = map[string]rune{
+	"up":        draw.KeyUp,
+	"down":      draw.KeyDown,
+	"left":      draw.KeyLeft,
+	"right":     draw.KeyRight,
+	"home":      draw.KeyHome,
+	"end":       draw.KeyEnd,
+	"pageup":    draw.KeyPageUp,
+	"pagedown":  draw.KeyPageDown,
+	"space":     ' ',
+	"enter":     '\n',
+	"tab":       '\t',
+	"delete":    draw.KeyDelete,
+	"backspace": draw.KeyBackspace,
+	"escape":    draw.KeyEscape,
+}
+
+var (
+	keyBindings map[rune]string // key to action
+	keyLabels   map[rune]string // key to name, for help
+	mainShown   bool            // whether the torrent list is shown, key bindings for torrents only work in the list
+	search      *duit.Field
+)
+
+// parseKey parses a key name: a single character, a name from keyNames, or "ctrl-" or "cmd-" followed by a character.
+func parseKey(s string) (rune, error) {
+	if k, ok := keyNames[s]; ok {
+		return k, nil
+	}
+	var mod func(rune) rune
+	switch {
+	case strings.HasPrefix(s, "ctrl-"):
+		s = s[len("ctrl-"):]
+		mod = func(r rune) rune { return r & 0x1f }
+	case strings.HasPrefix(s, "cmd-"):
+		s = s[len("cmd-"):]
+		mod = func(r rune) rune { return draw.KeyCmd + r }
+	}
+	r := []rune(s)
+	if len(r) != 1 {
+		return 0, fmt.Errorf("unknown key %q", s)
+	}
+	if mod != nil {
+		return mod(r[0]), nil
+	}
+	return r[0], nil
+}
+
+// loadKeys sets up the key bindings: the defaults, changed by keys.json in the application data directory.
+// That file maps key names to action names, an empty action removes a default binding.
+func loadKeys() {
+	keys := map[string]string{}
+	for k, a := range defaultKeys {
+		keys[k] = a
+	}
+	buf, err := ioutil.ReadFile(appDataDir() + "/keys.json")
+	if err == nil {
+		var l map[string]string
+		err = json.Unmarshal(buf, &l)
+		for k, a := range l {
+			keys[k] = a
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		logErrorf(nil, "reading key bindings: %s", err)
+	}
+
+	keyBindings = map[rune]string{}
+	keyLabels = map[rune]string{}
+	for name, action := range keys {
+		if action == "" {
+			continue
+		}
+		k, err := parseKey(name)
+		if err == nil && keyAction(action) == nil {
+			err = fmt.Errorf("unknown action %q", action)
+		}
+		if err != nil {
+			logErrorf(nil, "key binding %q: %s", name, err)
+			continue
+		}
+		keyBindings[k] = action
+		keyLabels[k] = name
+	}
+}
+
+// keyAction returns the function for an action, or nil if the action does not exist.
+func keyAction(action string) func() {
+	switch action {
+	case "up":
+		return func() { moveSelection(-1) }
+	case "down":
+		return func() { moveSelection(1) }
+	case "toggle":
+		return func() { clickButton(toggleActive) }
+	case "verify":
+		return func() { clickButton(verify) }
+	case "remove":
+		return func() {
+			if l := selectedTorrents(); len(l) > 0 && !remove.Disabled {
+				showView(confirmRemoveView(l, false))
+			}
+		}
+	case "search":
+		return func() { dui.Focus(search) }
+	case "paste":
+		return func() {
+			buf, ok := dui.ReadSnarf()
+			if s := strings.TrimSpace(string(buf)); ok && (strings.HasPrefix(s, "magnet:") || strings.HasSuffix(s, ".torrent")) {
+				addInput(s)
+			}
+		}
+	case "help":
+		return func() { showView(keysView()) }
+	case "close":
+		return func() {
+			if viewClose != nil {
+				viewClose()
+			} else {
+				showMain()
+			}
+		}
+	}
+	return nil
+}
+
+func clickButton(b *duit.Button) {
+	if !b.Disabled {
+		b.Click()
+	}
+}
+
+// selectRow makes row i the selected row.
+func selectRow(i int) {
+	for j, row := range list.Rows {
+		row.Selected = j == i
+	}
+	t := list.Rows[i].Value.(*torrent.Torrent)
+	updateButtons(t)
+	updateDetails(t)
+	dui.MarkLayout(nil)
+}
+
+func moveSelection(delta int) {
+	if len(list.Rows) == 0 {
+		return
+	}
+	i := 0
+	if l := list.Selected(); len(l) > 0 {
+		i = l[0] + delta
+	}
+	if i < 0 {
+		i = 0
+	} else if i >= len(list.Rows) {
+		i = len(list.Rows) - 1
+	}
+	selectRow(i)
+}
+
+// searchList selects the first torrent after row start with s in its name.
+func searchList(s string, start int) {
+	s = strings.ToLower(s)
+	n := len(list.Rows)
+	for j := 0; j < n && s != ""; j++ {
+		i := (start + j) % n
+		if strings.Contains(strings.ToLower(list.Rows[i].Value.(*torrent.Torrent).Name()), s) {
+			selectRow(i)
+			return
+		}
+	}
+}
+
+func newSearchField() *duit.Field {
+	search = &duit.Field{
+		Placeholder: "search...",
+		Changed: func(text string) (e duit.Event) {
+			searchList(text, 0)
+			return
+		},
+		Keys: func(k rune, m draw.Mouse) (e duit.Event) {
+			if k == '\n' {
+				// next match
+				e.Consumed = true
+				start := 0
+				if l := list.Selected(); len(l) > 0 {
+					start = l[0] + 1
+				}
+				searchList(search.Text, start)
+			}
+			return
+		},
+	}
+	return search
+}
+
+// keysBox is the top-level UI. Keys not used by the UI under the mouse are handled through the key bindings.
+type keysBox struct {
+	duit.Box
+}
+
+func (ui *keysBox) Mouse(dui *duit.DUI, self *duit.Kid, m draw.Mouse, origM draw.Mouse, orig image.Point) (r duit.Result) {
+	lastMouse = m.Point
+	return ui.Box.Mouse(dui, self, m, origM, orig)
+}
+
+func (ui *keysBox) Key(dui *duit.DUI, self *duit.Kid, k rune, m draw.Mouse, orig image.Point) (r duit.Result) {
+	r = ui.Box.Key(dui, self, k, m, orig)
+	if r.Consumed {
+		return
+	}
+	action, ok := keyBindings[k]
+	if !ok || !mainShown && action != "help" && action != "close" || mainShown && action == "close" {
+		return
+	}
+	if action == "help" && viewClose != nil {
+		// the keys view would abandon the dialog
+		return
+	}
+	r.Consumed = true
+	keyAction(action)()
+	return
+}
+
+// confirmRemoveView asks whether the torrents should really be removed, with or without their data.
+func confirmRemoveView(l []*torrent.Torrent, withData bool) duit.UI {
+	what := fmt.Sprintf("%d torrents", len(l))
+	if len(l) == 1 {
+		what = l[0].Name()
+	}
+	text := fmt.Sprintf("Remove %s? The data is kept.", what)
+	if withData {
+		text = fmt.Sprintf("Remove %s, and delete its data?", what)
+	}
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(6, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: text, Font: bold},
+			&duit.Button{
+				Text:     "remove",
+				Colorset: &dui.Danger,
+				Click: func() (e duit.Event) {
+					showMain()
+					for _, t := range l {
+						if migrations[t.InfoHash()] == nil {
+							removeTorrent(t, withData)
+						}
+					}
+					return
+				},
+			},
+			&duit.Button{
+				Text: "cancel",
+				Click: func() (e duit.Event) {
+					showMain()
+					return
+				},
+			},
+		),
+	}
+}
+
+// keysView returns the UI listing all key bindings.
+func keysView() duit.UI {
+	keys := map[string][]string{}
+	for k, action := range keyBindings {
+		keys[action] = append(keys[action], keyLabels[k])
+	}
+	var kids []duit.UI
+	for _, a := range keyActions {
+		l := keys[a.name]
+		sort.Strings(l)
+		kids = append(kids, &duit.Label{Text: strings.Join(l, ", ")}, &duit.Label{Text: a.name}, &duit.Label{Text: a.help})
+	}
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Key bindings", Font: bold},
+				&duit.Label{Text: "change in " + appDataDir() + "/keys.json, eg {\"x\": \"remove\", \"delete\": \"\"}"},
+				&duit.Grid{
+					Columns: 3,
+					Padding: []duit.Space{
+						{Top: 2, Right: 4, Bottom: 2, Left: 0},
+						{Top: 2, Right: 4, Bottom: 2, Left: 4},
+						{Top: 2, Right: 0, Bottom: 2, Left: 4},
+					},
+					Kids: duit.NewKids(kids...),
+				},
+				&duit.Button{
+					Text: "close",
+					Click: func() (e duit.Event) {
+						showMain()
+						return
+					},
+				},
+			),
+		}},
+	}
+}
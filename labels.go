@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// LabelDefaults are applied to torrents when they get the label.
+type LabelDefaults struct {
+	Dir       string  // Directory to store data in. Empty for the default. Data of existing torrents is moved.
+	SeedRatio float64 // Seeding goal, 0 for the default, -1 for none.
+	MaxConns  int     // Established connections, 0 for the default.
+	DownRate  int64   // Approximate download rate cap for all torrents with the label together, in bytes per second. 0 for none.
+	UpRate    int64   // Upload rate cap, like DownRate.
+}
+
+type transferRate struct {
+	down, up int64 // bytes per second
+}
+
+var (
+	labelList   *duit.Gridlist
+	labelFilter *string                        // label of torrents shown in the list, nil for all
+	torrentRate map[metainfo.Hash]transferRate // as of the last tick
+
+	// The torrent library only has rate limiters for the whole client.
+	// The rate caps of a label are approximated by lowering the established connections of its torrents while over the cap, and raising them again while well under.
+	torrentThrottle map[metainfo.Hash]int // established connections allowed by the rate cap of the label, 0 for no throttling
+)
+
+// labels returns the labels with defaults and the labels of torrents, sorted.
+func labels() []string {
+	m := map[string]bool{}
+	for l := range settings.Labels {
+		m[l] = true
+	}
+	for _, row := range torrentRows {
+		if l := torrentLabel[row.Value.(*torrent.Torrent).InfoHash()]; l != "" {
+			m[l] = true
+		}
+	}
+	var l []string
+	for s := range m {
+		l = append(l, s)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// labelDefaults sets the seeding goal and connections for h from the defaults of label, if any.
+func labelDefaults(h metainfo.Hash, label string) {
+	d := settings.Labels[label]
+	if d.SeedRatio != 0 {
+		torrentSeedRatio[h] = d.SeedRatio
+	}
+	if d.MaxConns > 0 {
+		torrentMaxConns[h] = d.MaxConns
+	}
+}
+
+// clearLabelDefaults removes the seeding goal and connections of h that came from the defaults of label.
+// Values that differ were set by hand and are kept.
+func clearLabelDefaults(h metainfo.Hash, label string) {
+	d := settings.Labels[label]
+	if d.SeedRatio != 0 && torrentSeedRatio[h] == d.SeedRatio {
+		delete(torrentSeedRatio, h)
+	}
+	if d.MaxConns > 0 && torrentMaxConns[h] == d.MaxConns {
+		delete(torrentMaxConns, h)
+	}
+}
+
+// setLabel changes the label of t, and applies the defaults of the new label instead of those of the old label.
+// Data is moved to the directory of the new label, if it has one.
+func setLabel(t *torrent.Torrent, label string) {
+	h := t.InfoHash()
+	if label == torrentLabel[h] {
+		return
+	}
+	clearLabelDefaults(h, torrentLabel[h])
+	delete(torrentThrottle, h)
+	if label == "" {
+		delete(torrentLabel, h)
+		applyLimits(t)
+		return
+	}
+	torrentLabel[h] = label
+	labelDefaults(h, label)
+	applyLimits(t)
+	dir := settings.Labels[label].Dir
+	if dir == "" || migrations[h] != nil {
+		return
+	}
+	if t.Info() != nil {
+		startMigration(t, torrentBackend(h), dir)
+		updateRow(findRow(t), false)
+		return
+	}
+	// nothing has been downloaded yet, we can just add it again with the new directory
+	row := findRow(t)
+	if row == nil || dir == torrentDir[h] {
+		return
+	}
+	mi := t.Metainfo()
+	spec := &torrent.TorrentSpec{
+		InfoHash:    h,
+		Trackers:    mi.AnnounceList,
+		DisplayName: t.Name(),
+	}
+	accountTransfer(t)
+	t.Drop()
+	delete(torrentStats, h)
+	torrentDir[h] = dir
+	if err := readdTorrent(row, spec); err != nil {
+		logErrorf(t, "adding with directory of label: %s", err)
+	}
+}
+
+// throttleLabels adjusts the connections of torrents with a label with rate caps, to keep the label within its caps.
+// Called each tick, after the rates have been updated.
+func throttleLabels() {
+	type usage struct {
+		down, up int64
+		l        []*torrent.Torrent
+	}
+	used := map[string]*usage{}
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		if migrations[h] != nil {
+			continue
+		}
+		label := torrentLabel[h]
+		d := settings.Labels[label]
+		if label == "" || d.DownRate <= 0 && d.UpRate <= 0 {
+			if torrentThrottle[h] > 0 {
+				delete(torrentThrottle, h)
+				applyLimits(t)
+			}
+			continue
+		}
+		u := used[label]
+		if u == nil {
+			u = &usage{}
+			used[label] = u
+		}
+		r := torrentRate[h]
+		u.down += r.down
+		u.up += r.up
+		u.l = append(u.l, t)
+	}
+
+	for label, u := range used {
+		d := settings.Labels[label]
+		// fraction of the caps in use, above 1 is over the cap
+		var f float64
+		if d.DownRate > 0 {
+			f = float64(u.down) / float64(d.DownRate)
+		}
+		if d.UpRate > 0 {
+			f = math.Max(f, float64(u.up)/float64(d.UpRate))
+		}
+		for _, t := range u.l {
+			h := t.InfoHash()
+			limit := maxConns(h)
+			n := torrentThrottle[h]
+			if n <= 0 {
+				n = limit
+			}
+			nn := n
+			if f > 1 {
+				nn = int(float64(n) / f)
+				if nn < 1 {
+					nn = 1
+				}
+			} else if f < 0.8 {
+				nn = n + 1 + n/4
+			}
+			if nn >= limit {
+				nn = 0
+			}
+			if nn != torrentThrottle[h] {
+				if nn == 0 {
+					delete(torrentThrottle, h)
+				} else {
+					torrentThrottle[h] = nn
+				}
+				applyLimits(t)
+			}
+		}
+	}
+}
+
+// filterRows shows the torrents matching labelFilter in the list.
+// Hidden torrents are deselected.
+func filterRows() {
+	list.Rows = nil
+	for _, row := range torrentRows {
+		if labelFilter == nil || torrentLabel[row.Value.(*torrent.Torrent).InfoHash()] == *labelFilter {
+			list.Rows = append(list.Rows, row)
+		} else {
+			row.Selected = false
+		}
+	}
+	dui.MarkLayout(nil)
+}
+
+// updateLabels refreshes the sidebar with the labels, their number of torrents and their rates.
+func updateLabels() {
+	type count struct {
+		n        int
+		down, up int64
+	}
+	counts := map[string]*count{}
+	all := &count{}
+	for _, row := range torrentRows {
+		h := row.Value.(*torrent.Torrent).InfoHash()
+		l := torrentLabel[h]
+		c := counts[l]
+		if c == nil {
+			c = &count{}
+			counts[l] = c
+		}
+		r := torrentRate[h]
+		for _, c := range []*count{c, all} {
+			c.n++
+			c.down += r.down
+			c.up += r.up
+		}
+	}
+
+	row := func(text string, label *string, c *count) *duit.Gridrow {
+		if c == nil {
+			c = &count{}
+		}
+		selected := label == nil && labelFilter == nil || label != nil && labelFilter != nil && *label == *labelFilter
+		return &duit.Gridrow{
+			Selected: selected,
+			Values:   []string{text, fmt.Sprintf("%d", c.n), fmt.Sprintf("%dk", c.down/1024), fmt.Sprintf("%dk", c.up/1024)},
+			Value:    label,
+		}
+	}
+	ll := labels()
+	if labelFilter != nil && *labelFilter != "" {
+		i := sort.SearchStrings(ll, *labelFilter)
+		if i == len(ll) || ll[i] != *labelFilter {
+			// label is gone
+			labelFilter = nil
+			filterRows()
+		}
+	}
+	rows := []*duit.Gridrow{row("all", nil, all)}
+	for _, l := range ll {
+		l := l
+		rows = append(rows, row(l, &l, counts[l]))
+	}
+	none := ""
+	rows = append(rows, row("no label", &none, counts[""]))
+	changed := len(rows) != len(labelList.Rows)
+	for i := 0; !changed && i < len(rows); i++ {
+		changed = rows[i].Selected != labelList.Rows[i].Selected || strings.Join(rows[i].Values, "\t") != strings.Join(labelList.Rows[i].Values, "\t")
+	}
+	if changed {
+		labelList.Rows = rows
+		dui.MarkLayout(nil)
+	}
+}
+
+// newLabelsSidebar returns the sidebar listing the labels, clicking a label filters the list.
+func newLabelsSidebar() duit.UI {
+	labelList = &duit.Gridlist{
+		Header:  &duit.Gridrow{Values: []string{"label", "#", "down", "up"}},
+		Halign:  []duit.Halign{duit.HalignLeft, duit.HalignRight, duit.HalignRight, duit.HalignRight},
+		Padding: duit.SpaceXY(2, 2),
+		Changed: func(index int) (e duit.Event) {
+			labelFilter = nil
+			if index >= 0 && labelList.Rows[index].Selected {
+				labelFilter = labelList.Rows[index].Value.(*string)
+			}
+			filterRows()
+			updateLabels()
+			updateButtons(selected())
+			updateDetails(selected())
+			return
+		},
+	}
+	updateLabels()
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 4),
+			Kids: duit.NewKids(
+				labelList,
+				&duit.Button{
+					Text: "label defaults",
+					Click: func() (e duit.Event) {
+						showView(labelDefaultsView())
+						return
+					},
+				},
+			),
+		}},
+	}
+}
+
+// labelDefaultsView returns the UI for editing the defaults of labels, and adding labels.
+func labelDefaultsView() duit.UI {
+	type fields struct {
+		dir, ratio, conns, down, up *duit.Field
+	}
+	var names []string
+	m := map[string]fields{}
+	var gridKids []duit.UI
+	add := func(name string, d LabelDefaults) {
+		var ratio, conns, down, up string
+		if d.SeedRatio != 0 {
+			ratio = fmt.Sprintf("%v", d.SeedRatio)
+		}
+		if d.MaxConns > 0 {
+			conns = fmt.Sprintf("%d", d.MaxConns)
+		}
+		if d.DownRate > 0 {
+			down = fmt.Sprintf("%d", d.DownRate/1024)
+		}
+		if d.UpRate > 0 {
+			up = fmt.Sprintf("%d", d.UpRate/1024)
+		}
+		f := fields{
+			&duit.Field{Text: d.Dir, Placeholder: "default"},
+			&duit.Field{Text: ratio, Placeholder: "default"},
+			&duit.Field{Text: conns, Placeholder: "default"},
+			&duit.Field{Text: down, Placeholder: "none"},
+			&duit.Field{Text: up, Placeholder: "none"},
+		}
+		names = append(names, name)
+		m[name] = f
+		gridKids = append(gridKids,
+			&duit.Label{Text: name},
+			&duit.Box{Width: 300, Kids: duit.NewKids(f.dir)},
+			&duit.Box{Width: 80, Kids: duit.NewKids(f.ratio)},
+			&duit.Box{Width: 80, Kids: duit.NewKids(f.conns)},
+			&duit.Box{Width: 80, Kids: duit.NewKids(f.down)},
+			&duit.Box{Width: 80, Kids: duit.NewKids(f.up)},
+		)
+	}
+	for _, l := range labels() {
+		add(l, settings.Labels[l])
+	}
+	grid := &duit.Grid{
+		Columns: 6,
+		Padding: []duit.Space{
+			{Top: 2, Right: 4, Bottom: 2, Left: 0},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 4, Bottom: 2, Left: 4},
+			{Top: 2, Right: 0, Bottom: 2, Left: 4},
+		},
+	}
+	setGrid := func() {
+		kids := []duit.UI{&duit.Label{Text: "label", Font: bold}, &duit.Label{Text: "directory", Font: bold}, &duit.Label{Text: "seed ratio", Font: bold}, &duit.Label{Text: "connections", Font: bold}, &duit.Label{Text: "down kb/s, approx.", Font: bold}, &duit.Label{Text: "up kb/s, approx.", Font: bold}}
+		grid.Kids = duit.NewKids(append(kids, gridKids...)...)
+	}
+	setGrid()
+
+	status := &duit.Label{}
+	var newLabel *duit.Field
+	newLabel = &duit.Field{
+		Placeholder: "new label...",
+		Keys: func(k rune, mouse draw.Mouse) (e duit.Event) {
+			if k != '\n' {
+				return
+			}
+			e.Consumed = true
+			if _, ok := m[newLabel.Text]; newLabel.Text != "" && !ok {
+				add(newLabel.Text, LabelDefaults{})
+				setGrid()
+			}
+			newLabel.Text = ""
+			dui.MarkLayout(nil)
+			return
+		},
+	}
+
+	save := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		nl := map[string]LabelDefaults{}
+		for _, name := range names {
+			f := m[name]
+			var d LabelDefaults
+			var err error
+			d.Dir = f.dir.Text
+			if f.ratio.Text != "" {
+				d.SeedRatio, err = strconv.ParseFloat(f.ratio.Text, 64)
+				if err != nil {
+					status.Text = fmt.Sprintf("%s: bad seed ratio: %s", name, err)
+					return
+				}
+			}
+			if f.conns.Text != "" {
+				d.MaxConns, err = strconv.Atoi(f.conns.Text)
+				if err == nil && d.MaxConns <= 0 {
+					err = fmt.Errorf("must be > 0")
+				}
+				if err != nil {
+					status.Text = fmt.Sprintf("%s: bad number of connections: %s", name, err)
+					return
+				}
+			}
+			for _, r := range []struct {
+				text string
+				v    *int64
+				what string
+			}{{f.down.Text, &d.DownRate, "download"}, {f.up.Text, &d.UpRate, "upload"}} {
+				if r.text == "" {
+					continue
+				}
+				*r.v, err = strconv.ParseInt(r.text, 10, 64)
+				if err == nil && *r.v < 0 {
+					err = fmt.Errorf("must be >= 0")
+				}
+				if err != nil {
+					status.Text = fmt.Sprintf("%s: bad %s rate cap: %s", name, r.what, err)
+					return
+				}
+				*r.v *= 1024
+			}
+			// labels without defaults are kept while torrents have them
+			if d != (LabelDefaults{}) {
+				nl[name] = d
+			}
+		}
+		settings.Labels = nl
+		saveSettings()
+		updateLabels()
+		showMain()
+		return
+	}
+
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Label defaults", Font: bold},
+				&duit.Label{Text: "applied to torrents when they get the label, their data is moved to the directory. rate caps hold for all torrents with the label together. they are approximate: the torrent library has no rate limits per torrent, so they are kept by limiting connections and can be exceeded."},
+				&duit.Label{Text: "labels without defaults are removed when no torrent has them."},
+				grid,
+				&duit.Box{Width: 200, Kids: duit.NewKids(newLabel)},
+				&duit.Box{
+					Margin: image.Pt(6, 0),
+					Kids: duit.NewKids(
+						&duit.Button{
+							Text:     "save",
+							Colorset: &dui.Primary,
+							Click:    save,
+						},
+						&duit.Button{
+							Text: "cancel",
+							Click: func() (e duit.Event) {
+								showMain()
+								return
+							},
+						},
+						status,
+					),
+				},
+			),
+		}},
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// Per-torrent limits, overriding the settings.
+var (
+	torrentMaxConns  map[metainfo.Hash]int     // established connections, 0 for the default
+	torrentSeedRatio map[metainfo.Hash]float64 // seeding goal, 0 for the settings default, -1 for none
+)
+
+// seedRatio returns the seeding goal for a torrent, 0 means none.
+func seedRatio(h metainfo.Hash) float64 {
+	r := torrentSeedRatio[h]
+	if r == 0 {
+		r = settings.SeedRatio
+	}
+	if r < 0 {
+		return 0
+	}
+	return r
+}
+
+// maxConns returns the established connections for h from its limits or the default.
+func maxConns(h metainfo.Hash) int {
+	n := torrentMaxConns[h]
+	if n <= 0 {
+		n = config.EstablishedConnsPerTorrent
+	}
+	return n
+}
+
+// applyLimits configures the client for the limits of t, lowered by the rate cap of its label.
+func applyLimits(t *torrent.Torrent) {
+	h := t.InfoHash()
+	n := maxConns(h)
+	if c := torrentThrottle[h]; c > 0 && c < n {
+		n = c
+	}
+	t.SetMaxEstablishedConns(n)
+}
+
+// limitsView returns the UI for setting limits on the torrents.
+func limitsView(l []*torrent.Torrent) duit.UI {
+	var conns, ratio string
+	if len(l) == 1 {
+		h := l[0].InfoHash()
+		if v := torrentMaxConns[h]; v > 0 {
+			conns = fmt.Sprintf("%d", v)
+		}
+		if v := torrentSeedRatio[h]; v != 0 {
+			ratio = fmt.Sprintf("%v", v)
+		}
+	}
+	connsField := &duit.Field{Text: conns, Placeholder: fmt.Sprintf("default, %d", config.EstablishedConnsPerTorrent)}
+	ratioField := &duit.Field{Text: ratio, Placeholder: fmt.Sprintf("default, %v", settings.SeedRatio)}
+	status := &duit.Label{}
+
+	apply := &duit.Button{
+		Text:     "apply",
+		Colorset: &dui.Primary,
+		Click: func() (e duit.Event) {
+			dui.MarkLayout(nil)
+			var n int
+			var r float64
+			var err error
+			if connsField.Text != "" {
+				n, err = strconv.Atoi(connsField.Text)
+				if err == nil && n <= 0 {
+					err = fmt.Errorf("must be > 0")
+				}
+				if err != nil {
+					status.Text = fmt.Sprintf("bad number of connections: %s", err)
+					return
+				}
+			}
+			if ratioField.Text != "" {
+				r, err = strconv.ParseFloat(ratioField.Text, 64)
+				if err != nil {
+					status.Text = fmt.Sprintf("bad seed ratio: %s", err)
+					return
+				}
+			}
+			for _, t := range l {
+				h := t.InfoHash()
+				if n > 0 {
+					torrentMaxConns[h] = n
+				} else {
+					delete(torrentMaxConns, h)
+				}
+				if r != 0 {
+					torrentSeedRatio[h] = r
+				} else {
+					delete(torrentSeedRatio, h)
+				}
+				applyLimits(t)
+			}
+			saveSession()
+			showMain()
+			return
+		},
+	}
+
+	title := fmt.Sprintf("Limits for %d torrents", len(l))
+	if len(l) == 1 {
+		title = "Limits for " + l[0].Name()
+	}
+	label := func(s string) *duit.Label {
+		return &duit.Label{Text: s}
+	}
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(0, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: title, Font: bold},
+			&duit.Grid{
+				Columns: 2,
+				Padding: []duit.Space{
+					{Top: 2, Right: 4, Bottom: 2, Left: 0},
+					{Top: 2, Right: 0, Bottom: 2, Left: 4},
+				},
+				Kids: duit.NewKids(
+					label("Established connections"), &duit.Box{Width: 150, Kids: duit.NewKids(connsField)},
+					label("Seed ratio (-1 for none)"), &duit.Box{Width: 150, Kids: duit.NewKids(ratioField)},
+				),
+			},
+			&duit.Label{Text: "client-wide rate limits are in the toolbar, caps per label in the label defaults"},
+			&duit.Box{
+				Margin: image.Pt(6, 0),
+				Kids: duit.NewKids(
+					apply,
+					&duit.Button{
+						Text: "cancel",
+						Click: func() (e duit.Event) {
+							showMain()
+							return
+						},
+					},
+					status,
+				),
+			},
+		),
+	}
+}
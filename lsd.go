@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Local Service Discovery (BEP 14) finds peers on the local network.
+// We multicast announces with the infohashes of active torrents, and add the senders of announces for our torrents as peers.
+// Private torrents and torrents without info (which could be private) are not announced.
+
+const (
+	lsdInterval  = 5 * time.Minute
+	lsdMaxHashes = 20 // per announce, to stay well within a single packet
+)
+
+var lsdGroups = []struct {
+	network, addr string
+	disabled      func() bool
+}{
+	{"udp4", "239.192.152.143:6771", func() bool { return settings.Network.DisableIPv4 }},
+	{"udp6", "[ff15::efc0:988f]:6771", func() bool { return settings.Network.DisableIPv6 }},
+}
+
+// lsdConn is a multicast socket for a group, for both sending and receiving announces.
+type lsdConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	host  string // for the Host header
+}
+
+// lsdAnnounce is a received announce.
+type lsdAnnounce struct {
+	ip     net.IP
+	port   int
+	hashes []metainfo.Hash
+}
+
+var (
+	torrentNoLSD  map[metainfo.Hash]bool // disabled for torrent
+	lsdConns      []*lsdConn             // nil while disabled
+	lsdAnnounces  = make(chan lsdAnnounce)
+	lsdLast       time.Time       // of previous announce
+	lsdSeen       map[string]bool // infohash and address of peers already logged
+	lsdCookie     = newLSDCookie()
+	lsdStartError string // of last attempt, to log it only once
+)
+
+func newLSDCookie() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// lsdEnabled returns whether t is announced and takes peers from local service discovery.
+func lsdEnabled(t *torrent.Torrent) bool {
+	h := t.InfoHash()
+	return !settings.Network.NoLSD && !torrentNoLSD[h] && t.Info() != nil && !isPrivate(t)
+}
+
+// startLSD joins the multicast groups, if not already done.
+func startLSD() {
+	if lsdConns != nil {
+		return
+	}
+	var errs []string
+	for _, g := range lsdGroups {
+		if g.disabled() {
+			continue
+		}
+		group, err := net.ResolveUDPAddr(g.network, g.addr)
+		var conn *net.UDPConn
+		if err == nil {
+			conn, err = net.ListenMulticastUDP(g.network, nil, group)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", g.addr, err))
+			continue
+		}
+		lc := &lsdConn{conn, group, g.addr}
+		lsdConns = append(lsdConns, lc)
+		go lsdReceive(lc)
+	}
+	if s := strings.Join(errs, "; "); s != "" && s != lsdStartError {
+		logWarnf(nil, "local service discovery: %s", s)
+		lsdStartError = s
+	}
+	if lsdConns == nil {
+		// try again next tick
+		return
+	}
+	lsdLast = time.Time{}
+	lsdSeen = map[string]bool{}
+}
+
+func stopLSD() {
+	for _, lc := range lsdConns {
+		lc.conn.Close()
+	}
+	lsdConns = nil
+}
+
+// updateLSD starts or stops local service discovery following the settings, and announces periodically. Called each tick.
+func updateLSD() {
+	if settings.Network.NoLSD {
+		stopLSD()
+		return
+	}
+	startLSD()
+	if lsdConns == nil || time.Since(lsdLast) < lsdInterval {
+		return
+	}
+	lsdLast = time.Now()
+
+	port := client.LocalPort()
+	if port == 0 {
+		return
+	}
+	var hashes []string
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		if torrentWant[h] && migrations[h] == nil && lsdEnabled(t) {
+			hashes = append(hashes, h.HexString())
+		}
+	}
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > lsdMaxHashes {
+			n = lsdMaxHashes
+		}
+		for _, lc := range lsdConns {
+			msg := lsdMessage(lc.host, port, hashes[:n])
+			if _, err := lc.conn.WriteToUDP(msg, lc.group); err != nil {
+				logWarnf(nil, "local service discovery announce to %s: %s", lc.host, err)
+			}
+		}
+		hashes = hashes[n:]
+	}
+}
+
+// lsdMessage returns a BEP 14 announce.
+func lsdMessage(host string, port int, hashes []string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, port)
+	for _, h := range hashes {
+		fmt.Fprintf(&b, "Infohash: %s\r\n", h)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n\r\n\r\n", lsdCookie)
+	return b.Bytes()
+}
+
+// parseLSDMessage parses an announce, returning the port and infohashes.
+// Our own announces are rejected.
+func parseLSDMessage(buf []byte) (int, []metainfo.Hash, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(buf)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, fmt.Errorf("not an announce")
+	}
+	hdr, err := r.ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return 0, nil, err
+	}
+	if hdr.Get("Cookie") == lsdCookie {
+		return 0, nil, fmt.Errorf("own announce")
+	}
+	port, err := strconv.Atoi(hdr.Get("Port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, fmt.Errorf("bad port %q", hdr.Get("Port"))
+	}
+	var hashes []metainfo.Hash
+	for _, s := range hdr["Infohash"] {
+		var h metainfo.Hash
+		if err := h.FromHexString(strings.TrimSpace(s)); err != nil {
+			return 0, nil, fmt.Errorf("bad infohash %q", s)
+		}
+		hashes = append(hashes, h)
+	}
+	return port, hashes, nil
+}
+
+// lsdReceive reads announces until the connection is closed, passing them to the main loop.
+func lsdReceive(lc *lsdConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := lc.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		port, hashes, err := parseLSDMessage(buf[:n])
+		if err != nil || len(hashes) == 0 {
+			continue
+		}
+		lsdAnnounces <- lsdAnnounce{addr.IP, port, hashes}
+	}
+}
+
+// gotLSDAnnounce adds the sender of an announce as peer to our torrents in it.
+func gotLSDAnnounce(a lsdAnnounce) {
+	if lsdConns == nil {
+		return
+	}
+	for _, h := range a.hashes {
+		row := findRowHash(h)
+		if row == nil {
+			continue
+		}
+		t := row.Value.(*torrent.Torrent)
+		if !torrentWant[h] || migrations[h] != nil || !lsdEnabled(t) {
+			continue
+		}
+		t.AddPeers([]torrent.Peer{{IP: a.ip, Port: a.port}})
+		addr := net.JoinHostPort(a.ip.String(), strconv.Itoa(a.port))
+		if k := h.HexString() + " " + addr; !lsdSeen[k] {
+			lsdSeen[k] = true
+			logInfof(t, "local peer %s from local service discovery", addr)
+		}
+	}
+}
@@ -7,8 +7,8 @@ import (
 	"image"
 	"log"
 	"os"
-	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"9fans.net/go/draw"
@@ -19,121 +19,97 @@ import (
 	"golang.org/x/time/rate"
 )
 
-const (
-	colStatus = iota
-	colName
-	colHave
-	colTotal
-	colETA
-	colDownrate
-	colUprate
-	nCol
-)
-
 var (
 	client  *torrent.Client
 	config  *torrent.ClientConfig
 	gotInfo chan *torrent.Torrent
 
-	dui                  *duit.DUI
-	list                 *duit.Gridlist
-	toggleActive, remove *duit.Button
-	details              *duit.Box
-	bold                 *draw.Font
-
-	columnNames = []string{
-		"status",
-		"name",
-		"completed",
-		"total",
-		"eta",
-		"downrate",
-		"uprate",
-	}
-	columnHalign = []duit.Halign{
-		duit.HalignLeft,
-		duit.HalignLeft,
-		duit.HalignRight,
-		duit.HalignRight,
-		duit.HalignRight,
-		duit.HalignRight,
-		duit.HalignRight,
-	}
+	dui                          *duit.DUI
+	list                         *duit.Gridlist
+	toggleActive, remove, verify *duit.Button
+	details                      *duit.Box
+	bold                         *draw.Font
+	top                          *keysBox
+	bar                          *duit.Box
+	vertical                     *duit.Split     // list and details
+	horizontal                   *duit.Split     // labels sidebar and vertical
+	mainView                     *duit.Split     // horizontal and status bar
+	torrentRows                  []*duit.Gridrow // all torrents, list.Rows has those matching the label filter
+	viewTick                     func()          // called on each tick while a view other than the main view is shown
+	nextViewTick                 func()          // set while creating a view, becomes viewTick when it is shown
+	viewClose                    func()          // called for the "close" key binding instead of showMain, for dialogs that must clean up
+	nextViewClose                func()          // set while creating a view, becomes viewClose when it is shown
+	logBanner                    *duit.Label     // recent error
 
 	torrentWant  map[metainfo.Hash]bool              // whether we currently want to download this torrent
 	torrentStats map[metainfo.Hash]torrent.ConnStats // previous stats, for calculating rate & eta
+	torrentDir   map[metainfo.Hash]string            // data directory, if not the default
+	torrentLabel map[metainfo.Hash]string
+	torrentAdded map[metainfo.Hash]time.Time
 
 	tickInterval = 2 * time.Second
 )
 
 func check(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s: %s\n", msg, err)
+		logErrorf(nil, "%s: %s", msg, err)
+		closeLogFile()
+		os.Exit(1)
 	}
 }
 
+// updateRow sets the values of the columns in row.
+// With updateStats, the rates and eta are calculated from the stats since the previous call with updateStats.
 func updateRow(row *duit.Gridrow, updateStats bool) {
 	t := row.Value.(*torrent.Torrent)
-
-	row.Values[colName] = t.String()
-	i := t.Info()
-	var status string
-	if i == nil {
-		status = "starting"
-	} else if t.Seeding() {
-		status = "seeding"
-	} else if !torrentWant[t.InfoHash()] {
-		status = "paused"
-	} else if t.BytesMissing() == 0 {
-		status = "finished"
-	} else {
-		status = "downloading"
+	migrating := migrations[t.InfoHash()] != nil
+	if updateStats && !migrating {
+		updateRates(t)
 	}
-	row.Values[colStatus] = status
-
-	have := "0"
-	total := "?"
-	if i != nil {
-		have = formatSize(t.BytesCompleted())
-		total = formatSize(t.BytesMissing() + t.BytesCompleted())
+	for i, c := range shownColumns {
+		if migrating && c.name != "status" && c.name != "name" {
+			continue
+		}
+		if c.info && t.Info() == nil {
+			row.Values[i] = "?"
+			continue
+		}
+		row.Values[i] = c.value(t)
 	}
-	row.Values[colHave] = have
-	row.Values[colTotal] = total
+}
 
-	if !updateStats {
-		return
-	}
+func updateRates(t *torrent.Torrent) {
+	h := t.InfoHash()
 	nstats := t.Stats().ConnStats
-	ostats, ok := torrentStats[t.InfoHash()]
-	torrentStats[t.InfoHash()] = nstats
+	ostats, ok := torrentStats[h]
+	torrentStats[h] = nstats
 	if !ok {
 		return
 	}
 
 	downrate := (nstats.BytesRead.Int64() - ostats.BytesRead.Int64()) * int64(time.Second) / int64(tickInterval)
 	uprate := (nstats.BytesWritten.Int64() - ostats.BytesWritten.Int64()) * int64(time.Second) / int64(tickInterval)
-	row.Values[colDownrate] = fmt.Sprintf("%dk", downrate/1024)
-	row.Values[colUprate] = fmt.Sprintf("%dk", uprate/1024)
+	torrentRate[h] = transferRate{downrate, uprate}
 
 	done := nstats.BytesRead.Int64() - ostats.BytesRead.Int64()
 	if done <= 0 {
-		row.Values[colETA] = "∞"
+		torrentETA[h] = "∞"
 		return
 	}
-	if i == nil {
-		row.Values[colETA] = "?"
+	if t.Info() == nil {
+		torrentETA[h] = "?"
 		return
 	}
-	secs := time.Duration(float64(tickInterval)*float64(t.BytesMissing())/float64(done)) / time.Second
+	secs := time.Duration(float64(tickInterval)*float64(bytesWantedMissing(t))/float64(done)) / time.Second
 	hours := secs / 3600
 	mins := (secs % 3600) / 60
 	secs = secs % 60
 	if hours > 0 {
-		row.Values[colETA] = fmt.Sprintf("%dh%02dm", hours, mins)
+		torrentETA[h] = fmt.Sprintf("%dh%02dm", hours, mins)
 	} else if mins > 0 {
-		row.Values[colETA] = fmt.Sprintf("%02dm%02ds", mins, secs)
+		torrentETA[h] = fmt.Sprintf("%02dm%02ds", mins, secs)
 	} else {
-		row.Values[colETA] = fmt.Sprintf("%02ds", secs)
+		torrentETA[h] = fmt.Sprintf("%02ds", secs)
 	}
 }
 
@@ -142,7 +118,7 @@ func formatSize(v int64) string {
 }
 
 func findRow(t *torrent.Torrent) *duit.Gridrow {
-	for _, row := range list.Rows {
+	for _, row := range torrentRows {
 		if row.Value == t {
 			return row
 		}
@@ -150,129 +126,159 @@ func findRow(t *torrent.Torrent) *duit.Gridrow {
 	return nil
 }
 
-func updateDetails(t *torrent.Torrent) {
-	if t == nil {
-		details.Kids = nil
-		return
+func findRowHash(h metainfo.Hash) *duit.Gridrow {
+	for _, row := range torrentRows {
+		if row.Value.(*torrent.Torrent).InfoHash() == h {
+			return row
+		}
 	}
-	i := t.Info()
-	if i == nil {
-		details.Kids = duit.NewKids(&duit.Label{
-			Text: "fetching metainfo...",
-		})
-		return
+	return nil
+}
+
+// savePath returns the directory the data of t is stored in, or the database file for the bolt storage backend.
+func savePath(t *torrent.Torrent) string {
+	h := t.InfoHash()
+	dir := torrentDir[h]
+	if dir == "" {
+		dir = defaultDataDir()
+	}
+	return storageDir(torrentBackend(h), dir, h)
+}
+
+// defaultDataDir returns the directory for torrents without their own directory.
+func defaultDataDir() string {
+	dir := config.DataDir
+	if dir == "" {
+		dir, _ = os.Getwd()
 	}
+	return dir
+}
 
-	var uis []duit.UI
+// addOpts are the options for adding a torrent.
+type addOpts struct {
+	Dir      string   // Directory to store data in. If empty, the client default is used.
+	Label    string   // Free-form label, can be empty.
+	Paused   bool     // If set, the torrent is not started.
+	Storage  string   // Storage backend, empty for the default.
+	WebSeeds []string // URLs of web seeds, from the metainfo or magnet link.
 
-	_box := func(top int, ui duit.UI) *duit.Box {
-		return &duit.Box{
-			Padding: duit.Space{Top: top},
-			Width:   -1,
-			Kids:    duit.NewKids(ui),
-		}
+	Restored bool // Torrent comes from the session file, so is not new to the user.
+}
+
+// addTorrent adds a torrent to the client and the list.
+// Adding a torrent that is already present returns the existing torrent.
+func addTorrent(spec *torrent.TorrentSpec, opts addOpts) (*torrent.Torrent, error) {
+	backend := opts.Storage
+	if backend == "" {
+		backend = torrentBackend(spec.InfoHash)
+	}
+	if opts.Dir == "" && !opts.Restored {
+		opts.Dir = settings.Labels[opts.Label].Dir
 	}
-	box := func(ui duit.UI) *duit.Box {
-		return _box(4, ui)
+	dir := opts.Dir
+	if dir == "" {
+		dir = defaultDataDir()
+	}
+	var err error
+	spec.Storage, err = newStorage(backend, dir)
+	if err != nil {
+		return nil, err
+	}
+	t, isNew, err := clientFor(spec).AddTorrentSpec(spec)
+	if err != nil {
+		return nil, err
 	}
-	titleBox := func(ui duit.UI) *duit.Box {
-		return _box(10, ui)
+	if !isNew {
+		return t, nil
 	}
 
-	makeGrid := func(elems ...string) *duit.Grid {
-		kids := make([]duit.UI, len(elems))
-		for i, s := range elems {
-			kids[i] = &duit.Label{Text: s}
-		}
-		return &duit.Grid{
-			Columns: 2,
-			Padding: []duit.Space{
-				{Top: 2, Right: 4, Bottom: 2, Left: 0},
-				{Top: 2, Right: 0, Bottom: 2, Left: 4},
-			},
-			Width: -1,
-			Kids:  duit.NewKids(kids...),
-		}
+	h := t.InfoHash()
+	if opts.Dir != "" {
+		torrentDir[h] = opts.Dir
+	}
+	if opts.Label != "" {
+		torrentLabel[h] = opts.Label
+	}
+	if opts.Storage != "" {
+		torrentStorage[h] = opts.Storage
+	}
+	addWebSeeds(h, opts.WebSeeds)
+	torrentWant[h] = !opts.Paused
+	readdManualPeers(t)
+	if !opts.Restored {
+		torrentAdded[h] = time.Now()
+		labelDefaults(h, opts.Label)
+	}
+	applyLimits(t)
+	if !opts.Restored {
+		runHook("added", t, nil)
+		defer saveSession()
 	}
 
-	var fileUIs []duit.UI
-	for _, f := range t.Files() {
-		name := &duit.Label{Text: f.Path()}
-		size := &duit.Label{Text: formatSize(f.Length())}
-		fileUIs = append(fileUIs, name, size)
+	defer dui.MarkLayout(nil)
+	nrow := &duit.Gridrow{
+		Values: make([]string, len(shownColumns)),
+		Value:  t,
 	}
-	filesGrid := &duit.Grid{
-		Columns: 2,
-		Padding: []duit.Space{
-			{Top: 2, Right: 4, Bottom: 2, Left: 0},
-			{Top: 2, Right: 0, Bottom: 2, Left: 4},
-		},
-		Width:  -1,
-		Halign: []duit.Halign{duit.HalignLeft, duit.HalignRight},
-		Kids:   duit.NewKids(fileUIs...),
-	}
-	uis = append(uis,
-		box(&duit.Label{Text: "Files", Font: bold}),
-		box(filesGrid),
-	)
-
-	uis = append(uis,
-		titleBox(&duit.Label{Text: "Info", Font: bold}),
-		box(makeGrid(
-			"Pieces", fmt.Sprintf("%d", t.NumPieces()),
-			"Piece length", fmt.Sprintf("%d", i.PieceLength),
-			"Name", i.Name,
-		)),
-	)
-
-	var announceUIs []duit.UI
-	al := t.Metainfo().AnnounceList.DistinctValues()
-	announces := make([]string, 0, len(al))
-	for k := range al {
-		announces = append(announces, k)
-	}
-	sort.Slice(announces, func(i, j int) bool {
-		return announces[i] < announces[j]
-	})
-	for _, v := range announces {
-		announceUIs = append(announceUIs, &duit.Box{
-			Width: -1,
-			Kids:  duit.NewKids(&duit.Label{Text: v}),
-		})
-	}
-	uis = append(uis,
-		titleBox(&duit.Label{Text: "Announces", Font: bold}),
-		&duit.Box{
-			Margin: image.Pt(0, 4),
-			Kids:   duit.NewKids(announceUIs...),
-		},
-	)
-
-	ts := t.Stats()
-	connGrid := makeGrid(
-		"Active peers", fmt.Sprintf("%d", ts.ActivePeers),
-		"Half open peers", fmt.Sprintf("%d", ts.HalfOpenPeers),
-		"Pending peers", fmt.Sprintf("%d", ts.PendingPeers),
-		"Total peers", fmt.Sprintf("%d", ts.TotalPeers),
-		"Chunks written", fmt.Sprintf("%d", ts.ConnStats.ChunksWritten),
-		"Chunks read", fmt.Sprintf("%d", ts.ConnStats.ChunksRead),
-		"Data written", formatSize(ts.ConnStats.BytesWritten.Int64()),
-		"Data read", formatSize(ts.ConnStats.BytesRead.Int64()),
-		"Total written (including overhead)", formatSize(ts.ConnStats.BytesWritten.Int64()),
-		"Total read", formatSize(ts.ConnStats.BytesRead.Int64()),
-	)
-
-	uis = append(uis,
-		titleBox(&duit.Label{Text: "Connection stats", Font: bold}),
-		box(connGrid),
-	)
-
-	details.Kids = duit.NewKids(uis...)
+	updateRow(nrow, false)
+	torrentRows = append([]*duit.Gridrow{nrow}, torrentRows...)
+	filterRows()
+	go func() {
+		<-t.GotInfo()
+		gotInfo <- t
+	}()
+	return t, nil
+}
+
+// readdTorrent adds the torrent of row again, eg after its storage changed or the client was replaced.
+// The torrent in row must already be dropped.
+func readdTorrent(row *duit.Gridrow, spec *torrent.TorrentSpec) error {
+	h := spec.InfoHash
+	dir := torrentDir[h]
+	if dir == "" {
+		dir = defaultDataDir()
+	}
+	var err error
+	spec.Storage, err = newStorage(torrentBackend(h), dir)
+	if err != nil {
+		return err
+	}
+	t, _, err := clientFor(spec).AddTorrentSpec(spec)
+	if err != nil {
+		return err
+	}
+	row.Value = t
+	applyLimits(t)
+	readdManualPeers(t)
+	updateRow(row, false)
+	go func() {
+		<-t.GotInfo()
+		gotInfo <- t
+	}()
+	return nil
+}
+
+// showView replaces the list and details with ui.
+func showView(ui duit.UI) {
+	viewTick = nextViewTick
+	nextViewTick = nil
+	viewClose = nextViewClose
+	nextViewClose = nil
+	mainShown = ui == mainView
+	top.Kids = duit.NewKids(bar, ui)
+	dui.MarkLayout(nil)
+}
+
+// showMain shows the list and details again.
+func showMain() {
+	showView(mainView)
 }
 
 func updateButtons(t *torrent.Torrent) {
-	toggleActive.Disabled = t == nil
-	remove.Disabled = t == nil
+	busy := t != nil && migrations[t.InfoHash()] != nil
+	toggleActive.Disabled = t == nil || busy
+	remove.Disabled = t == nil || busy
+	verify.Disabled = t == nil || busy || t.Info() == nil || verifying(t)
 
 	toggleActive.Text = "start"
 	if t != nil && torrentWant[t.InfoHash()] {
@@ -280,6 +286,119 @@ func updateButtons(t *torrent.Torrent) {
 	}
 }
 
+// setWant starts or pauses downloading t.
+func setWant(t *torrent.Torrent, want bool) {
+	dui.MarkLayout(nil)
+	torrentWant[t.InfoHash()] = want
+	if t == selected() {
+		updateButtons(t)
+		updateDetails(t)
+	}
+	if t.Info() == nil {
+		return
+	}
+	if want {
+		startDownload(t)
+	} else {
+		stopDownload(t)
+	}
+}
+
+// removeTorrent drops t and removes it from the list.
+// With withData, its data files are removed too.
+func removeTorrent(t *torrent.Torrent, withData bool) {
+	row := findRow(t)
+	if row == nil {
+		return
+	}
+	dui.MarkLayout(nil)
+	runHook("removed", t, nil)
+	var dataPath string
+	if info := t.Info(); withData && info != nil {
+		dataPath = torrentDataPath(t)
+		for i := 0; i < t.NumPieces(); i++ {
+			pieceCompletion.Set(metainfo.PieceKey{InfoHash: t.InfoHash(), Index: i}, false)
+		}
+	}
+	accountTransfer(t)
+	t.Drop()
+	if dataPath != "" {
+		if err := os.RemoveAll(dataPath); err != nil {
+			logErrorf(t, "removing data: %s", err)
+		} else {
+			logInfof(t, "removed data %s", dataPath)
+		}
+	} else if withData {
+		logWarnf(t, "data not removed")
+	}
+	deleteRow(row)
+	filterRows()
+	saveSession()
+	updateButtons(selected())
+	updateDetails(selected())
+}
+
+// torrentDataPath returns the file or directory with the data of t, or empty if the data is not in a separate file or directory, as with bolt storage.
+func torrentDataPath(t *torrent.Torrent) string {
+	h := t.InfoHash()
+	dir := torrentDir[h]
+	if dir == "" {
+		dir = defaultDataDir()
+	}
+	return dataPath(torrentBackend(h), dir, t.Info().Name, h)
+}
+
+// deleteRow removes row from the list of all torrents.
+func deleteRow(row *duit.Gridrow) {
+	for i, r := range torrentRows {
+		if r == row {
+			torrentRows = append(torrentRows[:i], torrentRows[i+1:]...)
+			break
+		}
+	}
+}
+
+// moveRow moves row to position i in the list of all torrents.
+func moveRow(row *duit.Gridrow, i int) {
+	deleteRow(row)
+	if i > len(torrentRows) {
+		i = len(torrentRows)
+	}
+	torrentRows = append(torrentRows[:i], append([]*duit.Gridrow{row}, torrentRows[i:]...)...)
+	filterRows()
+}
+
+// addMagnet adds a torrent for a magnet link, and selects it.
+// Unless disabled, the torrent is added paused and the add dialog is shown when its info arrives.
+func addMagnet(uri string) {
+	spec, err := torrent.TorrentSpecFromMagnetURI(uri)
+	if err != nil {
+		logErrorf(nil, "adding magnet: %s", err)
+		runHook("error", nil, fmt.Errorf("adding magnet: %s", err))
+		return
+	}
+	present := findRowHash(spec.InfoHash) != nil
+	t, err := addTorrent(spec, addOpts{Paused: !settings.NoAddDialog, WebSeeds: magnetWebSeeds(uri)})
+	if err != nil {
+		logErrorf(nil, "adding magnet: %s", err)
+		runHook("error", nil, fmt.Errorf("adding magnet: %s", err))
+		return
+	}
+	if !present && !settings.NoAddDialog {
+		pendingAdds[t.InfoHash()] = true
+	}
+	selectTorrent(t)
+}
+
+// addInput adds the magnet link or the torrent file at path s.
+func addInput(s string) {
+	if strings.HasPrefix(s, "magnet:") {
+		addMagnet(s)
+	} else {
+		addTorrentFile(s)
+	}
+}
+
 func selected() *torrent.Torrent {
 	l := list.Selected()
 	if len(l) == 0 {
@@ -290,6 +409,16 @@ func selected() *torrent.Torrent {
 	return list.Rows[i].Value.(*torrent.Torrent)
 }
 
+// selectTorrent makes t the only selected torrent.
+func selectTorrent(t *torrent.Torrent) {
+	for _, row := range list.Rows {
+		row.Selected = row.Value == t
+	}
+	updateButtons(t)
+	updateDetails(t)
+	dui.MarkLayout(nil)
+}
+
 func parseRate(s string) (rate.Limit, error) {
 	v, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
@@ -308,18 +437,26 @@ func main() {
 		log.Println("usage: duittorrent")
 		flag.PrintDefaults()
 	}
+	flag.StringVar(&settingsPath, "settings", appDataDir()+"/settings.json", "path to settings file")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) != 0 {
 		flag.Usage()
 		os.Exit(2)
 	}
+	log.SetOutput(stdLog{})
+	openLogFile()
+
+	loadSettings()
 
+	openPieceCompletion()
+	if settings.Storage != "" {
+		check(checkBackend(settings.Storage), "settings")
+	}
 	var err error
-	config = torrent.NewDefaultClientConfig()
-	config.UploadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
-	config.DownloadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
-	client, err = torrent.NewClient(config)
+	config, err = newClientConfig(settings.Network)
+	check(err, "client config")
+	client, privateClient, err = newClients(config)
 	check(err, "new torrent client")
 
 	dui, err = duit.NewDUI("torrent", nil)
@@ -334,83 +471,93 @@ func main() {
 	gotInfo = make(chan *torrent.Torrent)
 	torrentWant = map[metainfo.Hash]bool{}
 	torrentStats = map[metainfo.Hash]torrent.ConnStats{}
+	torrentDir = map[metainfo.Hash]string{}
+	torrentLabel = map[metainfo.Hash]string{}
+	torrentStorage = map[metainfo.Hash]string{}
+	migrations = map[metainfo.Hash]*migration{}
+	torrentCompleted = map[metainfo.Hash]bool{}
+	torrentSeeded = map[metainfo.Hash]bool{}
+	verifications = map[metainfo.Hash]*verification{}
+	lastVerified = map[metainfo.Hash]time.Time{}
+	torrentMaxConns = map[metainfo.Hash]int{}
+	torrentSeedRatio = map[metainfo.Hash]float64{}
+	torrentRate = map[metainfo.Hash]transferRate{}
+	torrentThrottle = map[metainfo.Hash]int{}
+	torrentETA = map[metainfo.Hash]string{}
+	torrentSwarm = map[metainfo.Hash]swarm{}
+	torrentAdded = map[metainfo.Hash]time.Time{}
+	torrentCompletedAt = map[metainfo.Hash]time.Time{}
+	torrentFiles = map[metainfo.Hash][]bool{}
+	torrentTotals = map[metainfo.Hash]*transferTotals{}
+	torrentWebSeeds = map[metainfo.Hash][]string{}
+	webSeeds = map[metainfo.Hash][]*webSeed{}
+	torrentNoLSD = map[metainfo.Hash]bool{}
+	torrentManualPeers = map[metainfo.Hash][]string{}
 
 	toggleActive = &duit.Button{
 		Text: "", // pause or start
 		Click: func() (e duit.Event) {
-			t := selected()
-			if t == nil {
-				log.Println("should not happen: toggle while no torrent selected")
+			l := selectedTorrents()
+			if len(l) == 0 {
+				logErrorf(nil, "should not happen: toggle while no torrent selected")
 				return
 			}
 
-			dui.MarkLayout(nil)
-			h := t.InfoHash()
-			nv := !torrentWant[h]
-			torrentWant[h] = nv
-			updateButtons(t)
-			updateDetails(t)
-			i := t.Info()
-			if i == nil {
+			// all selected torrents follow the first, as shown by the button
+			want := !torrentWant[l[0].InfoHash()]
+			for _, t := range l {
+				if migrations[t.InfoHash()] == nil {
+					setWant(t, want)
+				}
+			}
+			return
+		},
+	}
+	verify = &duit.Button{
+		Text: "verify",
+		Click: func() (e duit.Event) {
+			l := selectedTorrents()
+			if len(l) == 0 {
+				logErrorf(nil, "should not happen: verify while no torrent selected")
 				return
 			}
-			if nv {
-				t.DownloadAll()
-			} else {
-				t.CancelPieces(0, t.NumPieces())
+			dui.MarkLayout(nil)
+			for _, t := range l {
+				if t.Info() != nil && !verifying(t) && migrations[t.InfoHash()] == nil {
+					startVerify(t)
+					updateRow(findRow(t), false)
+				}
 			}
+			updateButtons(selected())
+			updateDetails(selected())
 			return
 		},
 	}
 	remove = &duit.Button{
 		Text: "remove",
 		Click: func() (e duit.Event) {
-			l := list.Selected()
+			l := selectedTorrents()
 			if len(l) == 0 {
-				log.Println("should not happen: remove of torrent while none selected")
+				logErrorf(nil, "should not happen: remove of torrent while none selected")
 				return
 			}
-			dui.MarkLayout(nil)
-			i := l[0]
-			row := list.Rows[i]
-			t := row.Value.(*torrent.Torrent)
-			t.Drop()
-			list.Rows = append(list.Rows[:i], list.Rows[i+1:]...)
-			updateButtons(nil)
-			updateDetails(nil)
+			if len(l) > 1 {
+				showView(confirmRemoveView(l, false))
+				return
+			}
+			removeTorrent(l[0], false)
 			return
 		},
 	}
 	var input *duit.Field
 	input = &duit.Field{
-		Placeholder: "magnet...",
+		Placeholder: "magnet or torrent file...",
 		Keys: func(k rune, m draw.Mouse) (e duit.Event) {
 			if k == '\n' && len(input.Text) > 0 {
-				uri := input.Text
+				s := input.Text
 				input.Text = ""
 				e.Consumed = true
-				t, err := client.AddMagnet(uri)
-				if err != nil {
-					log.Printf("adding magnet: %s\n", err)
-					return
-				}
-				defer dui.MarkLayout(nil)
-				nrow := &duit.Gridrow{
-					Values:   make([]string, nCol),
-					Value:    t,
-					Selected: true,
-				}
-				updateRow(nrow, false)
-				for _, row := range list.Rows {
-					row.Selected = false
-				}
-				list.Rows = append([]*duit.Gridrow{nrow}, list.Rows...)
-				updateButtons(t)
-				updateDetails(t)
-				go func() {
-					<-t.GotInfo()
-					gotInfo <- t
-				}()
+				addInput(s)
 			}
 			return
 		},
@@ -425,7 +572,7 @@ func main() {
 
 				v, err := parseRate(s)
 				if err != nil {
-					log.Printf("bad rate: %s\n", err)
+					logErrorf(nil, "bad rate: %s", err)
 					maxUp.Text = ""
 					e.NeedDraw = true
 					return
@@ -445,7 +592,7 @@ func main() {
 
 				v, err := parseRate(s)
 				if err != nil {
-					log.Printf("bad rate: %s\n", err)
+					logErrorf(nil, "bad rate: %s", err)
 					maxDown.Text = ""
 					e.NeedDraw = true
 					return
@@ -456,16 +603,27 @@ func main() {
 		},
 	}
 
-	bar := &duit.Box{
+	logBanner = &duit.Label{
+		Click: func() (e duit.Event) {
+			showView(logView())
+			return
+		},
+	}
+	bar = &duit.Box{
 		Padding: duit.SpaceXY(6, 4),
 		Margin:  image.Pt(6, 4),
 		Kids: duit.NewKids(
 			toggleActive,
+			verify,
 			remove,
 			&duit.Box{
 				Width: 300,
 				Kids:  duit.NewKids(input),
 			},
+			&duit.Box{
+				Width: 150,
+				Kids:  duit.NewKids(newSearchField()),
+			},
 			&duit.Label{Text: "max up kb/s:"},
 			&duit.Box{
 				Width: 80,
@@ -476,22 +634,66 @@ func main() {
 				Width: 80,
 				Kids:  duit.NewKids(maxDown),
 			},
+			&duit.Button{
+				Text: "columns",
+				Click: func() (e duit.Event) {
+					showView(columnsView())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "network",
+				Click: func() (e duit.Event) {
+					showView(networkView())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "blocklist",
+				Click: func() (e duit.Event) {
+					showView(blocklistView())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "bad peers",
+				Click: func() (e duit.Event) {
+					showView(badPeersView())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "diagnostics",
+				Click: func() (e duit.Event) {
+					showView(diagnosticsView())
+					return
+				},
+			},
+			&duit.Button{
+				Text: "log",
+				Click: func() (e duit.Event) {
+					showView(logView())
+					return
+				},
+			},
+			logBanner,
 		),
 	}
 	list = &duit.Gridlist{
-		Halign:  columnHalign,
-		Padding: duit.SpaceXY(2, 2),
-		Striped: true,
-		Header: &duit.Gridrow{
-			Values: columnNames,
+		Padding:  duit.SpaceXY(2, 2),
+		Striped:  true,
+		Multiple: true,
+		Click: func(index int, m draw.Mouse) (e duit.Event) {
+			if m.Buttons == duit.Button3 {
+				e.Consumed = true
+				rowMenu(index)
+			}
+			return
 		},
 		Changed: func(index int) (e duit.Event) {
+			// with multiple selected, the details and buttons are for the first
 			defer dui.MarkLayout(nil)
-			row := list.Rows[index]
-			var t *torrent.Torrent
-			if row.Selected {
-				t = row.Value.(*torrent.Torrent)
-			}
+			t := selected()
 			updateButtons(t)
 			updateDetails(t)
 			return
@@ -506,12 +708,9 @@ func main() {
 	}
 	details = &duit.Box{
 		Padding: duit.SpaceXY(6, 4),
+		Height:  -1,
 	}
-	detailsBox := &duit.Scroll{
-		Height: -1,
-		Kid:    duit.Kid{UI: details},
-	}
-	vertical := &duit.Split{
+	vertical = &duit.Split{
 		Gutter:   1,
 		Vertical: true,
 		Split: func(height int) []int {
@@ -519,21 +718,57 @@ func main() {
 		},
 		Kids: duit.NewKids(
 			listBox,
-			detailsBox,
+			details,
 		),
 	}
-	dui.Top.UI = &duit.Box{
+	horizontal = &duit.Split{
+		Gutter: 1,
+		Split: func(width int) []int {
+			w := dui.Scale(220)
+			if w > width/3 {
+				w = width / 3
+			}
+			return []int{w, width - w}
+		},
 		Kids: duit.NewKids(
-			bar,
+			newLabelsSidebar(),
 			vertical,
 		),
 	}
+	horizontal.Kids[1].ID = "vertical" // duit stores the split position
+	statusBar = &duit.Label{}
+	mainView = &duit.Split{
+		Vertical: true,
+		Split: func(height int) []int {
+			h := dui.Display.DefaultFont.Height + dui.Scale(4)
+			return []int{height - h, h}
+		},
+		Kids: duit.NewKids(
+			horizontal,
+			&duit.Box{Padding: duit.SpaceXY(6, 2), Kids: duit.NewKids(statusBar)},
+		),
+	}
+	applyColumns()
+	loadKeys()
+	top = &keysBox{}
+	dui.Top.UI = top
+	showMain()
 
+	restoreSession()
+	loadAllTime()
+	updateStatusBar()
 	updateButtons(nil)
 	updateDetails(nil)
 	dui.Render()
 
+	startStream()
+	startMetrics()
+	startFeeds()
+	startBlocklist()
+	loadBadPeers()
+
 	tick := time.Tick(tickInterval)
+	sessionTick := time.Tick(time.Minute)
 
 	for {
 		select {
@@ -542,29 +777,83 @@ func main() {
 
 		case err, ok := <-dui.Error:
 			if !ok {
+				saveSession()
+				saveDHTNodes()
+				client.Close()
+				privateClient.Close()
+				closePieceCompletion()
+				closeLogFile()
 				return
 			}
-			log.Printf("duit: %s\n", err)
+			logErrorf(nil, "duit: %s", err)
 
 		case <-tick:
-			for _, row := range list.Rows {
+			checkWatchFolders()
+			checkScheduledVerify()
+			checkBadPeers()
+			checkErrorHooks()
+			updateSwarms()
+			updateWebSeeds()
+			updateLSD()
+			updateLogBanner()
+			accountAll()
+			updateStatusBar()
+			for _, row := range torrentRows {
 				updateRow(row, true)
+				if t := row.Value.(*torrent.Torrent); migrations[t.InfoHash()] == nil {
+					checkHooks(t)
+				}
+			}
+			throttleLabels()
+			updateLabels()
+			showAdds()
+			if viewTick != nil {
+				viewTick()
+			}
+			updateDetails(selected())
+			if mainShown {
+				dui.MarkDraw(list)
+				dui.MarkDraw(details)
 			}
-			t := selected()
-			updateDetails(t)
-			dui.MarkDraw(list)
-			dui.MarkDraw(details)
 			dui.Render()
 
+		case <-sessionTick:
+			saveSession()
+			saveDHTNodes()
+
+		case l := <-streamRequests:
+			l.c <- lookupStream(l.hash)
+
+		case c := <-metricsRequests:
+			c <- gatherMetrics()
+
+		case a := <-lsdAnnounces:
+			gotLSDAnnounce(a)
+
 		case t := <-gotInfo:
 			// torrent could have been closed in the mean time
 			row := findRow(t)
 			if row == nil {
 				continue
 			}
+			if movePrivate(row, t) {
+				// the new torrent object sends its info again
+				continue
+			}
 
 			if torrentWant[t.InfoHash()] {
-				t.DownloadAll()
+				startDownload(t)
+			}
+			if !restoredInfo[t.InfoHash()] {
+				runHook("gotinfo", t, nil)
+				addDefaultTrackers(t)
+				// torrent can be added again, eg with another directory
+				restoredInfo[t.InfoHash()] = true
+			}
+			gotAddInfo(t)
+			if _, ok := lastVerified[t.InfoHash()]; !ok {
+				// first time, restored torrents have it from the session
+				lastVerified[t.InfoHash()] = time.Now()
 			}
 			updateRow(row, false)
 			if row.Selected {
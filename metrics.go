@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/torrent"
+	"golang.org/x/time/rate"
+)
+
+// Metrics are served in the Prometheus text format at /metrics.
+// They are gathered in the main loop, which owns the state of the torrents.
+
+// requests for metrics from the HTTP server, nil if not running
+var metricsRequests chan chan []byte
+
+// startMetrics starts the HTTP server for metrics, if enabled in the settings.
+func startMetrics() {
+	if settings.MetricsAddr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", settings.MetricsAddr)
+	check(err, "listen for metrics")
+	metricsRequests = make(chan chan []byte)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		err := http.Serve(ln, mux)
+		logErrorf(nil, "metrics server: %s", err)
+	}()
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c := make(chan []byte, 1)
+	select {
+	case metricsRequests <- c:
+	case <-r.Context().Done():
+		return
+	}
+	buf := <-c
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf)
+}
+
+// metricFamily is a metric with all its samples.
+type metricFamily struct {
+	name, typ, help string
+	samples         []string
+}
+
+type metrics struct {
+	families []*metricFamily
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels formats label pairs, eg metricLabels("kind", "data").
+func metricLabels(pairs ...string) string {
+	var l []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		l = append(l, fmt.Sprintf(`%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1])))
+	}
+	return strings.Join(l, ",")
+}
+
+// add adds a sample to metric name, which is created with typ and help on first use.
+func (m *metrics) add(name, typ, help, labels string, v float64) {
+	var f *metricFamily
+	for _, ff := range m.families {
+		if ff.name == name {
+			f = ff
+		}
+	}
+	if f == nil {
+		f = &metricFamily{name: name, typ: typ, help: help}
+		m.families = append(m.families, f)
+	}
+	s := name
+	if labels != "" {
+		s += "{" + labels + "}"
+	}
+	f.samples = append(f.samples, s+" "+strconv.FormatFloat(v, 'f', -1, 64))
+}
+
+func (m *metrics) gauge(name, help, labels string, v float64) {
+	m.add(name, "gauge", help, labels, v)
+}
+
+func (m *metrics) counter(name, help, labels string, v int64) {
+	m.add(name, "counter", help, labels, float64(v))
+}
+
+func (m *metrics) bytes() []byte {
+	var b bytes.Buffer
+	for _, f := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintln(&b, s)
+		}
+	}
+	return b.Bytes()
+}
+
+// metricState returns the state of t for metrics, the status in the list without progress.
+func metricState(t *torrent.Torrent) string {
+	return strings.Fields(torrentStatus(t))[0]
+}
+
+// limitValue returns the rate limit l for metrics, with +Inf for no limit.
+func limitValue(l rate.Limit) float64 {
+	if l == rate.Inf {
+		return math.Inf(1)
+	}
+	return float64(l)
+}
+
+// gatherMetrics returns the current metrics in the Prometheus text format.
+func gatherMetrics() []byte {
+	m := &metrics{}
+
+	stateNames := []string{"migrating", "starting", "checking", "seeding", "paused", "finished", "downloading"}
+	states := map[string]int{}
+	var total transferRate
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		states[metricState(t)]++
+		r := torrentRate[t.InfoHash()]
+		total.down += r.down
+		total.up += r.up
+	}
+	for _, s := range stateNames {
+		m.gauge("duittorrent_torrents", "Torrents by state.", metricLabels("state", s), float64(states[s]))
+	}
+	m.gauge("duittorrent_rate_bytes", "Transfer rate of all torrents over the last tick, in bytes per second.", metricLabels("direction", "down"), float64(total.down))
+	m.gauge("duittorrent_rate_bytes", "", metricLabels("direction", "up"), float64(total.up))
+	m.gauge("duittorrent_rate_limit_bytes", "Rate limit in bytes per second, +Inf for none.", metricLabels("direction", "down"), limitValue(config.DownloadRateLimiter.Limit()))
+	m.gauge("duittorrent_rate_limit_bytes", "", metricLabels("direction", "up"), limitValue(config.UploadRateLimiter.Limit()))
+	for _, s := range client.DhtServers() {
+		st := s.Stats()
+		addr := s.Addr().String()
+		m.gauge("duittorrent_dht_nodes", "Nodes in the DHT routing table, good ones responded to our last query.", metricLabels("server", addr, "state", "all"), float64(st.Nodes))
+		m.gauge("duittorrent_dht_nodes", "", metricLabels("server", addr, "state", "good"), float64(st.GoodNodes))
+	}
+
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		tl := metricLabels("infohash", h.HexString(), "name", t.Name(), "label", torrentLabel[h])
+		with := func(pairs ...string) string {
+			return tl + "," + metricLabels(pairs...)
+		}
+
+		m.gauge("duittorrent_torrent_state", "State of the torrent, 1 for the current state.", with("state", metricState(t)), 1)
+		m.gauge("duittorrent_torrent_list_position", "Position of the torrent in the list.", tl, float64(listPosition(t)))
+		if migrations[h] != nil {
+			// torrent is replaced during migration
+			continue
+		}
+
+		st := t.Stats()
+		m.counter("duittorrent_torrent_written_bytes_total", "Bytes sent to peers, on the wire or as piece data.", with("kind", "wire"), st.BytesWritten.Int64())
+		m.counter("duittorrent_torrent_written_bytes_total", "", with("kind", "data"), st.BytesWrittenData.Int64())
+		m.counter("duittorrent_torrent_read_bytes_total", "Bytes received from peers, on the wire, as piece data or as piece data we needed.", with("kind", "wire"), st.BytesRead.Int64())
+		m.counter("duittorrent_torrent_read_bytes_total", "", with("kind", "data"), st.BytesReadData.Int64())
+		m.counter("duittorrent_torrent_read_bytes_total", "", with("kind", "useful"), st.BytesReadUsefulData.Int64())
+		m.counter("duittorrent_torrent_written_chunks_total", "Chunks sent to peers.", tl, st.ChunksWritten.Int64())
+		m.counter("duittorrent_torrent_read_chunks_total", "Chunks received from peers, all, needed or wasted.", with("kind", "all"), st.ChunksRead.Int64())
+		m.counter("duittorrent_torrent_read_chunks_total", "", with("kind", "useful"), st.ChunksReadUseful.Int64())
+		m.counter("duittorrent_torrent_read_chunks_total", "", with("kind", "wasted"), st.ChunksReadWasted.Int64())
+		m.counter("duittorrent_torrent_pieces_total", "Pieces written to that passed or failed their hash check.", with("result", "good"), st.PiecesDirtiedGood.Int64())
+		m.counter("duittorrent_torrent_pieces_total", "", with("result", "bad"), st.PiecesDirtiedBad.Int64())
+		for _, p := range []struct {
+			state string
+			n     int
+		}{
+			{"known", st.TotalPeers},
+			{"pending", st.PendingPeers},
+			{"half_open", st.HalfOpenPeers},
+			{"active", st.ActivePeers},
+			{"seeder", st.ConnectedSeeders},
+		} {
+			m.gauge("duittorrent_torrent_peers", "Peers by state, known includes pending and connected peers.", with("state", p.state), float64(p.n))
+		}
+		if t.Info() == nil {
+			continue
+		}
+		m.gauge("duittorrent_torrent_size_bytes", "Size of the torrent data.", tl, float64(t.Length()))
+		m.gauge("duittorrent_torrent_completed_bytes", "Data downloaded and verified.", tl, float64(t.BytesCompleted()))
+		m.gauge("duittorrent_torrent_missing_bytes", "Data still to be downloaded for the selected files.", tl, float64(bytesWantedMissing(t)))
+	}
+	return m.bytes()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// metricsClient sets up a client with one paused torrent with a label and rates, and answers metrics requests like the main loop.
+func metricsClient(t *testing.T) (h metainfo.Hash, cleanup func()) {
+	closeClient := newTestClient(t)
+	config.DownloadRateLimiter.SetLimit(10 * 1024)
+
+	info := metainfo.Info{Name: "one", PieceLength: 16 * 1024, Length: 3, Pieces: make([]byte, 20)}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h = metainfo.HashBytes(infoBytes)
+	tor, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: h, InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tor.GotInfo()
+
+	torrentRows = []*duit.Gridrow{{Value: tor}}
+	torrentWant = map[metainfo.Hash]bool{}
+	torrentLabel = map[metainfo.Hash]string{h: "work"}
+	torrentRate = map[metainfo.Hash]transferRate{h: {2048, 1024}}
+	torrentFiles = map[metainfo.Hash][]bool{}
+	migrations = map[metainfo.Hash]*migration{}
+	verifications = map[metainfo.Hash]*verification{}
+
+	metricsRequests = make(chan chan []byte)
+	go func() {
+		for c := range metricsRequests {
+			c <- gatherMetrics()
+		}
+	}()
+	return h, func() {
+		close(metricsRequests)
+		closeClient()
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	h, cleanup := metricsClient(t)
+	defer cleanup()
+
+	srv := httptest.NewServer(http.HandlerFunc(serveMetrics))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("post: got status %d, expected %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("got content-type %q", ct)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every sample must follow the HELP and TYPE of its family, families are not repeated
+	commentRegexp := regexp.MustCompile(`^# (HELP|TYPE) ([a-z_]+) (.*)$`)
+	sampleRegexp := regexp.MustCompile(`^([a-z_]+)(\{[a-z_]+="[^"]*"(,[a-z_]+="[^"]*")*\})? ([-+]?([0-9.]+|Inf))$`)
+	samples := map[string]string{}
+	typed := map[string]bool{}
+	var family string
+	for _, line := range strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n") {
+		if m := commentRegexp.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				if typed[m[2]] {
+					t.Fatalf("family %s repeated", m[2])
+				}
+				if m[3] != "gauge" && m[3] != "counter" {
+					t.Fatalf("bad type in %q", line)
+				}
+				typed[m[2]] = true
+			}
+			family = m[2]
+			continue
+		}
+		m := sampleRegexp.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("bad line %q", line)
+		}
+		if m[1] != family {
+			t.Fatalf("sample %q not in family %s", line, family)
+		}
+		samples[m[1]+m[2]] = m[4]
+	}
+
+	tl := `infohash="` + h.HexString() + `",name="one",label="work"`
+	expect := map[string]string{
+		`duittorrent_torrents{state="paused"}`:                 "1",
+		`duittorrent_torrents{state="seeding"}`:                "0",
+		`duittorrent_rate_bytes{direction="down"}`:             "2048",
+		`duittorrent_rate_bytes{direction="up"}`:               "1024",
+		`duittorrent_rate_limit_bytes{direction="down"}`:       "10240",
+		`duittorrent_rate_limit_bytes{direction="up"}`:         "+Inf",
+		`duittorrent_torrent_state{` + tl + `,state="paused"}`: "1",
+		`duittorrent_torrent_list_position{` + tl + `}`:        "1",
+		`duittorrent_torrent_size_bytes{` + tl + `}`:           "3",
+		`duittorrent_torrent_completed_bytes{` + tl + `}`:      "0",
+		`duittorrent_torrent_missing_bytes{` + tl + `}`:        "3",
+	}
+	for k, v := range expect {
+		if samples[k] != v {
+			t.Errorf("%s: got %q, expected %q", k, samples[k], v)
+		}
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	s := metricLabels("name", "a \"b\"\\\nc", "label", "")
+	expect := `name="a \"b\"\\\nc",label=""`
+	if s != expect {
+		t.Fatalf("got %s, expected %s", s, expect)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net"
+	"strconv"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+	"golang.org/x/time/rate"
+)
+
+// NetworkSettings configure the torrent client.
+// Zero values keep the defaults of the torrent library.
+type NetworkSettings struct {
+	ListenHost                 string
+	ListenPort                 int // 0 keeps the default of the torrent library, which picks a random port.
+	NoDHT                      bool
+	DisablePEX                 bool
+	NoLSD                      bool // Local service discovery, BEP 14.
+	DisableTrackers            bool
+	DisableUTP                 bool
+	DisableTCP                 bool
+	DisableIPv4                bool
+	DisableIPv6                bool
+	Encryption                 string // One of encryptionPolicies.
+	ProxyURL                   string
+	EstablishedConnsPerTorrent int
+	HalfOpenConnsPerTorrent    int
+	PublicIP4                  string
+	PublicIP6                  string
+}
+
+var encryptionPolicies = []string{"", "disable", "prefer-none", "force"}
+
+// newClientConfig returns a client config with the network settings applied.
+// Rate limiters are taken from the current config, if any.
+func newClientConfig(ns NetworkSettings) (*torrent.ClientConfig, error) {
+	cfg := torrent.NewDefaultClientConfig()
+	if config != nil {
+		cfg.UploadRateLimiter = config.UploadRateLimiter
+		cfg.DownloadRateLimiter = config.DownloadRateLimiter
+	} else {
+		cfg.UploadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
+		cfg.DownloadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
+	}
+
+	host := ns.ListenHost
+	cfg.ListenHost = func(string) string { return host }
+	if ns.ListenPort > 0 {
+		cfg.ListenPort = ns.ListenPort
+	}
+	cfg.NoDHT = ns.NoDHT
+	cfg.DhtStartingNodes = dhtStartingNodes()
+	cfg.DisablePEX = ns.DisablePEX
+	cfg.DisableTrackers = ns.DisableTrackers
+	cfg.DisableUTP = ns.DisableUTP
+	cfg.DisableTCP = ns.DisableTCP
+	cfg.DisableIPv4 = ns.DisableIPv4
+	cfg.DisableIPv6 = ns.DisableIPv6
+	switch ns.Encryption {
+	case "":
+	case "disable":
+		cfg.DisableEncryption = true
+	case "prefer-none":
+		cfg.PreferNoEncryption = true
+	case "force":
+		cfg.ForceEncryption = true
+	default:
+		return nil, fmt.Errorf("unknown encryption policy %q", ns.Encryption)
+	}
+	cfg.ProxyURL = ns.ProxyURL
+	if ns.EstablishedConnsPerTorrent > 0 {
+		cfg.EstablishedConnsPerTorrent = ns.EstablishedConnsPerTorrent
+	}
+	if ns.HalfOpenConnsPerTorrent > 0 {
+		cfg.HalfOpenConnsPerTorrent = ns.HalfOpenConnsPerTorrent
+	}
+	var err error
+	cfg.PublicIp4, err = parseIP(ns.PublicIP4)
+	if err != nil {
+		return nil, err
+	}
+	cfg.PublicIp6, err = parseIP(ns.PublicIP6)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.IPBlocklist = ipBlocklist
+	cfg.DefaultStorage, err = newStorage(torrentBackend(metainfo.Hash{}), defaultDataDir())
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func parseIP(s string) (net.IP, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad IP address %q", s)
+	}
+	return ip, nil
+}
+
+// applyNetworkSettings makes ns the active network settings.
+// Most settings require a new client, in which case all torrents are added again to the new client.
+func applyNetworkSettings(ns NetworkSettings) error {
+	ons := settings.Network
+	if ns == ons {
+		return nil
+	}
+
+	// number of established conns and local service discovery can be changed on the fly
+	live := ons
+	live.EstablishedConnsPerTorrent = ns.EstablishedConnsPerTorrent
+	live.NoLSD = ns.NoLSD
+	if live == ns {
+		cfg, err := newClientConfig(ns)
+		if err != nil {
+			return err
+		}
+		config.EstablishedConnsPerTorrent = cfg.EstablishedConnsPerTorrent
+		for _, t := range clientTorrents() {
+			applyLimits(t)
+		}
+		settings.Network = ns
+		saveSettings()
+		return nil
+	}
+
+	if len(verifications) > 0 || len(migrations) > 0 {
+		for _, v := range verifications {
+			if v.running {
+				return fmt.Errorf("cannot restart client while verifying")
+			}
+		}
+		if len(migrations) > 0 {
+			return fmt.Errorf("cannot restart client while migrating storage")
+		}
+	}
+
+	cfg, err := newClientConfig(ns)
+	if err != nil {
+		return err
+	}
+	saveDHTNodes()
+	stopLSD() // joined again with the new settings
+	accountAll()
+	client.Close()
+	privateClient.Close()
+	ncl, npcl, err := newClients(cfg)
+	if err != nil {
+		logErrorf(nil, "new client with new network settings: %s, restoring previous settings", err)
+		cfg, xerr := newClientConfig(ons)
+		if xerr == nil {
+			ncl, npcl, xerr = newClients(cfg)
+		}
+		check(xerr, "new torrent client with previous settings")
+		config, client, privateClient = cfg, ncl, npcl
+		readdTorrents()
+		return err
+	}
+	config, client, privateClient = cfg, ncl, npcl
+	settings.Network = ns
+	saveSettings()
+	readdTorrents()
+	return nil
+}
+
+// readdTorrents adds all torrents in the list to the (new) client.
+func readdTorrents() {
+	for _, row := range torrentRows {
+		ot := row.Value.(*torrent.Torrent)
+		delete(torrentStats, ot.InfoHash())
+		if migrations[ot.InfoHash()] == nil {
+			accountTransfer(ot)
+		}
+		mi := ot.Metainfo()
+		spec := &torrent.TorrentSpec{
+			InfoHash:    ot.InfoHash(),
+			Trackers:    mi.AnnounceList,
+			InfoBytes:   mi.InfoBytes,
+			DisplayName: ot.Name(),
+		}
+		if err := readdTorrent(row, spec); err != nil {
+			logErrorf(ot, "adding to new client: %s", err)
+		}
+	}
+	if t := selected(); t != nil {
+		updateButtons(t)
+		updateDetails(t)
+	}
+	dui.MarkLayout(nil)
+}
+
+// networkView returns the UI for changing network settings.
+func networkView() duit.UI {
+	ns := settings.Network
+
+	field := func(s string) *duit.Field {
+		return &duit.Field{Text: s}
+	}
+	intField := func(v int) *duit.Field {
+		s := ""
+		if v != 0 {
+			s = fmt.Sprintf("%d", v)
+		}
+		return field(s)
+	}
+	checkbox := func(v bool) *duit.Checkbox {
+		return &duit.Checkbox{Checked: v}
+	}
+
+	listenHost := field(ns.ListenHost)
+	listenPort := intField(ns.ListenPort)
+	dht := checkbox(!ns.NoDHT)
+	pex := checkbox(!ns.DisablePEX)
+	lsd := checkbox(!ns.NoLSD)
+	trackers := checkbox(!ns.DisableTrackers)
+	utp := checkbox(!ns.DisableUTP)
+	tcp := checkbox(!ns.DisableTCP)
+	ipv4 := checkbox(!ns.DisableIPv4)
+	ipv6 := checkbox(!ns.DisableIPv6)
+	encryption := &duit.Buttongroup{Texts: []string{"default", "disable", "prefer none", "force"}}
+	for i, s := range encryptionPolicies {
+		if s == ns.Encryption {
+			encryption.Selected = i
+		}
+	}
+	proxy := field(ns.ProxyURL)
+	established := intField(ns.EstablishedConnsPerTorrent)
+	halfOpen := intField(ns.HalfOpenConnsPerTorrent)
+	publicIP4 := field(ns.PublicIP4)
+	publicIP6 := field(ns.PublicIP6)
+	status := &duit.Label{}
+
+	parseInt := func(name string, f *duit.Field) (int, error) {
+		if f.Text == "" {
+			return 0, nil
+		}
+		v, err := strconv.Atoi(f.Text)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("bad %s %q", name, f.Text)
+		}
+		return v, nil
+	}
+
+	apply := &duit.Button{
+		Text:     "apply",
+		Colorset: &dui.Primary,
+		Click: func() (e duit.Event) {
+			dui.MarkLayout(nil)
+			nns := NetworkSettings{
+				ListenHost:      listenHost.Text,
+				NoDHT:           !dht.Checked,
+				DisablePEX:      !pex.Checked,
+				NoLSD:           !lsd.Checked,
+				DisableTrackers: !trackers.Checked,
+				DisableUTP:      !utp.Checked,
+				DisableTCP:      !tcp.Checked,
+				DisableIPv4:     !ipv4.Checked,
+				DisableIPv6:     !ipv6.Checked,
+				Encryption:      encryptionPolicies[encryption.Selected],
+				ProxyURL:        proxy.Text,
+				PublicIP4:       publicIP4.Text,
+				PublicIP6:       publicIP6.Text,
+			}
+			var err error
+			nns.ListenPort, err = parseInt("listen port", listenPort)
+			if err == nil {
+				nns.EstablishedConnsPerTorrent, err = parseInt("established connections", established)
+			}
+			if err == nil {
+				nns.HalfOpenConnsPerTorrent, err = parseInt("half-open connections", halfOpen)
+			}
+			if err == nil {
+				err = applyNetworkSettings(nns)
+			}
+			if err != nil {
+				status.Text = err.Error()
+			} else {
+				status.Text = "applied"
+			}
+			return
+		},
+	}
+
+	label := func(s string) *duit.Label {
+		return &duit.Label{Text: s}
+	}
+	dhtNodes, updateDHTNodes := dhtNodesUI()
+	nextViewTick = updateDHTNodes
+	grid := &duit.Grid{
+		Columns: 2,
+		Padding: []duit.Space{
+			{Top: 2, Right: 4, Bottom: 2, Left: 0},
+			{Top: 2, Right: 0, Bottom: 2, Left: 4},
+		},
+		Width: -1,
+		Kids: duit.NewKids(
+			label("Listen host"), listenHost,
+			label("Listen port (0: random)"), listenPort,
+			label("DHT"), dht,
+			label("Peer exchange"), pex,
+			label("Local service discovery"), lsd,
+			label("Trackers"), trackers,
+			label("uTP"), utp,
+			label("TCP"), tcp,
+			label("IPv4"), ipv4,
+			label("IPv6"), ipv6,
+			label("Encryption"), encryption,
+			label("Proxy URL"), proxy,
+			label("Established connections per torrent"), established,
+			label("Half-open connections per torrent"), halfOpen,
+			label("Public IPv4"), publicIP4,
+			label("Public IPv6"), publicIP6,
+		),
+	}
+	return &duit.Scroll{
+		Height: -1,
+		Kid: duit.Kid{UI: &duit.Box{
+			Padding: duit.SpaceXY(6, 4),
+			Margin:  image.Pt(0, 6),
+			Kids: duit.NewKids(
+				&duit.Label{Text: "Network settings", Font: bold},
+				&duit.Box{Width: -1, Kids: duit.NewKids(grid)},
+				dhtNodes,
+				&duit.Box{
+					Margin: image.Pt(6, 0),
+					Kids: duit.NewKids(
+						apply,
+						&duit.Button{
+							Text: "close",
+							Click: func() (e duit.Event) {
+								showMain()
+								return
+							},
+						},
+						status,
+					),
+				},
+			),
+		}},
+	}
+}
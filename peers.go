@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// Peers can be added by hand in the peers tab, and exported to and imported from text files with a host:port per line.
+// Peers added by hand or imported are remembered, added again when the torrent is added again, and tagged "manual" in the peers tab.
+// KnownSwarm of the torrent library reads the peer lists without taking the client lock, racing with the goroutines of the client, also when called from the main loop.
+// So exports have only the connected peers and the peers added by hand, as the export UI and file say.
+
+var torrentManualPeers map[metainfo.Hash][]string // ip:port
+
+// parsePeers resolves the host:port addresses in s, separated by white space or commas.
+// Lines starting with # are ignored.
+func parsePeers(s string) ([]string, error) {
+	var l []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, f := range strings.FieldsFunc(line, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' }) {
+			addr, err := net.ResolveTCPAddr("tcp", f)
+			if err != nil {
+				return nil, err
+			}
+			if addr.IP == nil || addr.Port == 0 {
+				return nil, fmt.Errorf("%s: need host and port", f)
+			}
+			l = append(l, addr.String())
+		}
+	}
+	return l, nil
+}
+
+// peersOf returns the peers for addrs, ip:port as returned by parsePeers.
+func peersOf(addrs []string) []torrent.Peer {
+	var l []torrent.Peer
+	for _, s := range addrs {
+		if addr, err := net.ResolveTCPAddr("tcp", s); err == nil {
+			l = append(l, torrent.Peer{IP: addr.IP, Port: addr.Port})
+		}
+	}
+	return l
+}
+
+// addManualPeers adds addrs as peers to t, and remembers them.
+func addManualPeers(t *torrent.Torrent, addrs []string) {
+	h := t.InfoHash()
+	for _, s := range addrs {
+		known := false
+		for _, o := range torrentManualPeers[h] {
+			known = known || o == s
+		}
+		if !known {
+			torrentManualPeers[h] = append(torrentManualPeers[h], s)
+		}
+	}
+	t.AddPeers(peersOf(addrs))
+}
+
+// readdManualPeers adds the remembered peers to a new torrent object.
+func readdManualPeers(t *torrent.Torrent) {
+	if l := torrentManualPeers[t.InfoHash()]; len(l) > 0 {
+		t.AddPeers(peersOf(l))
+	}
+}
+
+// swarmAddrs returns the connected peers and the peers added by hand, as ip:port.
+func swarmAddrs(t *torrent.Torrent) []string {
+	seen := map[string]bool{}
+	var l []string
+	peers, _ := parseStatus(clientStatus(t))
+	for _, ps := range peers {
+		if !seen[ps.addr] {
+			seen[ps.addr] = true
+			l = append(l, ps.addr)
+		}
+	}
+	for _, s := range torrentManualPeers[t.InfoHash()] {
+		if !seen[s] {
+			seen[s] = true
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+func peersExportPath(t *torrent.Torrent) string {
+	return appDataDir() + "/peers-" + t.InfoHash().HexString() + ".txt"
+}
+
+// exportPeers writes the peers of t to path, returning their number.
+func exportPeers(t *torrent.Torrent, path string) (int, error) {
+	l := swarmAddrs(t)
+	s := fmt.Sprintf("# peers of %s, %s\n# connected and added by hand only, peers known but not connected are not included\n", t.Name(), t.InfoHash().HexString())
+	for _, addr := range l {
+		s += addr + "\n"
+	}
+	return len(l), ioutil.WriteFile(path, []byte(s), 0666)
+}
+
+// importPeers adds the peers in the file at path to t, returning their number.
+func importPeers(t *torrent.Torrent, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l, err := parsePeers(scanner.Text())
+		if err != nil {
+			return 0, err
+		}
+		addrs = append(addrs, l...)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	addManualPeers(t, addrs)
+	return len(addrs), nil
+}
+
+// peersField returns the UI for adding peers by hand, and for exporting and importing peers.
+func peersField(t *torrent.Torrent) duit.UI {
+	status := &duit.Label{}
+	field := &duit.Field{Placeholder: "host:port, ..."}
+	pathField := &duit.Field{Text: peersExportPath(t)}
+	add := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		addrs, err := parsePeers(field.Text)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no peers")
+		}
+		if err != nil {
+			status.Text = err.Error()
+			return
+		}
+		addManualPeers(t, addrs)
+		saveSession()
+		logInfof(t, "added peers by hand: %s", strings.Join(addrs, ", "))
+		field.Text = ""
+		status.Text = fmt.Sprintf("added %d peers", len(addrs))
+		return
+	}
+	field.Keys = func(k rune, m draw.Mouse) (e duit.Event) {
+		if k == '\n' {
+			e = add()
+			e.Consumed = true
+		}
+		return
+	}
+	export := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		n, err := exportPeers(t, pathField.Text)
+		if err != nil {
+			status.Text = "exporting peers: " + err.Error()
+		} else {
+			status.Text = fmt.Sprintf("exported %d peers, connected and added by hand only", n)
+		}
+		return
+	}
+	imp := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		n, err := importPeers(t, pathField.Text)
+		if err != nil {
+			status.Text = "importing peers: " + err.Error()
+			return
+		}
+		saveSession()
+		logInfof(t, "imported %d peers from %s", n, pathField.Text)
+		status.Text = fmt.Sprintf("imported %d peers", n)
+		return
+	}
+	return &duit.Box{
+		Margin: image.Pt(6, 4),
+		Kids: duit.NewKids(
+			&duit.Box{Width: 300, Kids: duit.NewKids(field)},
+			&duit.Button{Text: "add peers", Click: add},
+			&duit.Box{Width: 300, Kids: duit.NewKids(pathField)},
+			&duit.Button{Text: "export connected", Click: export},
+			&duit.Button{Text: "import", Click: imp},
+			status,
+		),
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"image"
+	"strings"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// Private torrents (BEP 27) may only get peers from their trackers.
+// The torrent library has DHT and PEX as client settings only, so private torrents are added to a second client with both disabled.
+// Magnets are added to the main client, their privacy is known once the info arrives, after which private torrents are moved.
+// Until then, a magnet of a private torrent is announced on the DHT and its peers can be found through DHT and PEX.
+// Holding magnets back from the DHT would leave magnets without (working) trackers without peers, so we don't.
+
+// client for private torrents, without DHT and PEX
+var privateClient *torrent.Client
+
+// newClients returns the main client for cfg, and the client for private torrents.
+func newClients(cfg *torrent.ClientConfig) (*torrent.Client, *torrent.Client, error) {
+	cl, err := torrent.NewClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	pcfg := *cfg
+	pcfg.NoDHT = true
+	pcfg.DisablePEX = true
+	pcfg.ListenPort = 0 // port of the main client is taken
+	pcl, err := torrent.NewClient(&pcfg)
+	if err != nil {
+		cl.Close()
+		return nil, nil, err
+	}
+	return cl, pcl, nil
+}
+
+// clientTorrents returns the torrents of both clients.
+func clientTorrents() []*torrent.Torrent {
+	return append(client.Torrents(), privateClient.Torrents()...)
+}
+
+// torrentClient returns the client t was added to.
+func torrentClient(t *torrent.Torrent) *torrent.Client {
+	if pt, ok := privateClient.Torrent(t.InfoHash()); ok && pt == t {
+		return privateClient
+	}
+	return client
+}
+
+// badPeerIPs returns the IPs banned by both clients.
+func badPeerIPs() []string {
+	return append(client.BadPeerIPs(), privateClient.BadPeerIPs()...)
+}
+
+// infoPrivate returns whether info has the private flag set.
+func infoPrivate(info *metainfo.Info) bool {
+	return info != nil && info.Private != nil && *info.Private
+}
+
+// isPrivate returns whether t is a private torrent. False while its info is not known.
+func isPrivate(t *torrent.Torrent) bool {
+	return infoPrivate(t.Info())
+}
+
+// specPrivate returns whether spec is for a private torrent, from its info bytes.
+func specPrivate(spec *torrent.TorrentSpec) bool {
+	if spec.InfoBytes == nil {
+		return false
+	}
+	var info metainfo.Info
+	return bencode.Unmarshal(spec.InfoBytes, &info) == nil && infoPrivate(&info)
+}
+
+// clientFor returns the client to add spec to.
+func clientFor(spec *torrent.TorrentSpec) *torrent.Client {
+	if specPrivate(spec) {
+		return privateClient
+	}
+	return client
+}
+
+// movePrivate adds t, a private torrent that just got its info, to the client for private torrents.
+// Returns whether t was moved, in which case it is dropped and the row has a new torrent.
+func movePrivate(row *duit.Gridrow, t *torrent.Torrent) bool {
+	if !isPrivate(t) {
+		return false
+	}
+	if torrentClient(t) == privateClient {
+		return false
+	}
+	h := t.InfoHash()
+	mi := t.Metainfo()
+	spec := &torrent.TorrentSpec{
+		InfoHash:    h,
+		Trackers:    mi.AnnounceList,
+		InfoBytes:   mi.InfoBytes,
+		DisplayName: t.Name(),
+	}
+	accountTransfer(t)
+	t.Drop()
+	delete(torrentStats, h)
+	if err := readdTorrent(row, spec); err != nil {
+		logErrorf(t, "adding private torrent without DHT and PEX: %s", err)
+		return true
+	}
+	logInfof(row.Value.(*torrent.Torrent), "private torrent, no longer using DHT and PEX")
+	return true
+}
+
+// addDefaultTrackers adds the default trackers from the settings to t, unless it is private.
+// Called when a new torrent gets its info.
+func addDefaultTrackers(t *torrent.Torrent) {
+	if len(settings.DefaultTrackers) == 0 {
+		return
+	}
+	if isPrivate(t) {
+		logInfof(t, "private torrent, not adding default trackers")
+		return
+	}
+	t.AddTrackers([][]string{settings.DefaultTrackers})
+}
+
+// copyMagnets writes the magnet links of l to the snarf buffer.
+func copyMagnets(l []*torrent.Torrent) {
+	var s []string
+	for _, t := range l {
+		mi := t.Metainfo()
+		s = append(s, mi.Magnet(t.Name(), t.InfoHash()).String())
+		if isPrivate(t) {
+			logWarnf(t, "copied magnet of private torrent")
+		}
+	}
+	dui.WriteSnarf([]byte(strings.Join(s, "\n")))
+}
+
+// confirmCopyMagnetView returns the UI asking for confirmation before copying magnets when l has private torrents.
+// Their magnets have the tracker URLs, which often hold a personal key, and lose the private flag.
+func confirmCopyMagnetView(l []*torrent.Torrent) duit.UI {
+	return &duit.Box{
+		Padding: duit.SpaceXY(6, 4),
+		Margin:  image.Pt(6, 6),
+		Kids: duit.NewKids(
+			&duit.Label{Text: "Copy magnet of private torrent?", Font: bold},
+			&duit.Label{Text: "the magnet has the tracker urls, which often hold your personal key. it doesn't have the private flag, clients adding it will use DHT and PEX."},
+			&duit.Button{
+				Text:     "copy",
+				Colorset: &dui.Danger,
+				Click: func() (e duit.Event) {
+					showMain()
+					copyMagnets(l)
+					return
+				},
+			},
+			&duit.Button{
+				Text: "cancel",
+				Click: func() (e duit.Event) {
+					showMain()
+					return
+				},
+			},
+		),
+	}
+}
+
+// torrentName returns the name of t for the list, with a marker for private torrents.
+func torrentName(t *torrent.Torrent) string {
+	if isPrivate(t) {
+		return t.String() + " (private)"
+	}
+	return t.String()
+}
+
+// trackerField returns the UI for adding a tracker to t by hand.
+// Private torrents only work with their own trackers, adding another requires confirmation.
+func trackerField(t *torrent.Torrent) duit.UI {
+	status := &duit.Label{}
+	field := &duit.Field{Placeholder: "tracker url..."}
+	confirm := ""
+	add := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		s := strings.TrimSpace(field.Text)
+		if s == "" {
+			status.Text = "empty url"
+			return
+		}
+		if isPrivate(t) && confirm != s {
+			confirm = s
+			status.Text = "private torrent: other trackers can leak it, and most private trackers ban for it. add again to confirm"
+			return
+		}
+		if isPrivate(t) {
+			logWarnf(t, "added tracker %s to private torrent", s)
+		} else {
+			logInfof(t, "added tracker %s", s)
+		}
+		t.AddTrackers([][]string{{s}})
+		saveSession()
+		confirm = ""
+		field.Text = ""
+		status.Text = "added"
+		return
+	}
+	field.Keys = func(k rune, m draw.Mouse) (e duit.Event) {
+		if k == '\n' {
+			e = add()
+			e.Consumed = true
+		}
+		return
+	}
+	return &duit.Box{
+		Margin: image.Pt(6, 4),
+		Kids: duit.NewKids(
+			&duit.Box{Width: 300, Kids: duit.NewKids(field)},
+			&duit.Button{Text: "add tracker", Click: add},
+			status,
+		),
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// sessionTorrent is a torrent in the session file, which is written periodically and on exit, and read at startup.
+type sessionTorrent struct {
+	InfoHash     string
+	InfoBytes    []byte     // Bencoded info dictionary, absent while we haven't received it.
+	Trackers     [][]string // Tiered.
+	DisplayName  string     // Used while info is not yet available.
+	Want         bool
+	Dir          string
+	Label        string
+	Storage      string     // Backend, empty for the default.
+	Completed    bool       // "completed" hook has fired.
+	Seeded       bool       // "seeded" hook has fired.
+	Added        time.Time  // Zero if unknown.
+	CompletedAt  time.Time  // Zero if unknown.
+	MaxConns     int        // Established connections, 0 for the default.
+	SeedRatio    float64    // Seeding goal, 0 for the default.
+	Files        []dataFile // State of data files, for detecting changes.
+	Selected     []bool     // Files to download, by index. Nil for all.
+	WebSeeds     []string   // URLs.
+	Downloaded   int64      // Data received, over all sessions.
+	Uploaded     int64      // Data sent, over all sessions.
+	ActiveSecs   int64      // Time wanted, over all sessions.
+	SeedingSecs  int64      // Time wanted with all selected files complete, over all sessions.
+	NoLSD        bool       // Local service discovery disabled.
+	ManualPeers  []string   // ip:port of peers added by hand.
+	LastVerified time.Time  // Of the data, or when the info was first received. Zero if unknown.
+}
+
+// torrents restored with info or that already got it, for which we don't fire the "gotinfo" hook
+var restoredInfo = map[metainfo.Hash]bool{}
+
+func sessionPath() string {
+	return appDataDir() + "/session.json"
+}
+
+// saveSession writes all torrents in the list to the session file.
+func saveSession() {
+	accountAll()
+	l := []sessionTorrent{}
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		st := sessionTorrent{
+			InfoHash:     h.HexString(),
+			DisplayName:  t.Name(),
+			Want:         torrentWant[h],
+			Dir:          torrentDir[h],
+			Label:        torrentLabel[h],
+			Storage:      torrentStorage[h],
+			Completed:    torrentCompleted[h],
+			Seeded:       torrentSeeded[h],
+			Added:        torrentAdded[h],
+			CompletedAt:  torrentCompletedAt[h],
+			MaxConns:     torrentMaxConns[h],
+			SeedRatio:    torrentSeedRatio[h],
+			Selected:     torrentFiles[h],
+			WebSeeds:     torrentWebSeeds[h],
+			NoLSD:        torrentNoLSD[h],
+			ManualPeers:  torrentManualPeers[h],
+			LastVerified: lastVerified[h],
+		}
+		if tt := torrentTotals[h]; tt != nil {
+			st.Downloaded = tt.downloaded
+			st.Uploaded = tt.uploaded
+			st.ActiveSecs = int64(tt.active / time.Second)
+			st.SeedingSecs = int64(tt.seeding / time.Second)
+		}
+		mi := t.Metainfo()
+		st.Trackers = mi.AnnounceList
+		if i := t.Info(); i != nil {
+			st.InfoBytes = mi.InfoBytes
+			st.Files = statDataFiles(i, savePath(t))
+		}
+		l = append(l, st)
+	}
+	buf, err := json.MarshalIndent(l, "", "\t")
+	if err == nil {
+		os.MkdirAll(appDataDir(), 0777)
+		err = ioutil.WriteFile(sessionPath()+".tmp", buf, 0666)
+	}
+	if err == nil {
+		err = os.Rename(sessionPath()+".tmp", sessionPath())
+	}
+	if err != nil {
+		logErrorf(nil, "saving session: %s", err)
+	}
+	saveAllTime()
+}
+
+// restoreSession adds the torrents from the session file.
+func restoreSession() {
+	buf, err := ioutil.ReadFile(sessionPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf(nil, "reading session: %s", err)
+		}
+		return
+	}
+	var l []sessionTorrent
+	err = json.Unmarshal(buf, &l)
+	if err != nil {
+		logErrorf(nil, "parsing session: %s", err)
+		return
+	}
+
+	// addTorrent prepends to the list, so add in reverse to keep the order
+	for i := len(l) - 1; i >= 0; i-- {
+		st := l[i]
+		spec := &torrent.TorrentSpec{
+			Trackers:    st.Trackers,
+			InfoBytes:   st.InfoBytes,
+			DisplayName: st.DisplayName,
+		}
+		if err := spec.InfoHash.FromHexString(st.InfoHash); err != nil {
+			logErrorf(nil, "restoring torrent: bad infohash %q: %s", st.InfoHash, err)
+			continue
+		}
+		if st.InfoBytes != nil {
+			var info metainfo.Info
+			if err := bencode.Unmarshal(st.InfoBytes, &info); err != nil {
+				logErrorf(nil, "restoring torrent %s: %s", st.DisplayName, err)
+				continue
+			}
+			dir := st.Dir
+			if dir == "" {
+				dir = defaultDataDir()
+			}
+			backend := st.Storage
+			if backend == "" {
+				backend = torrentBackend(spec.InfoHash)
+			}
+			if backend != "bolt" {
+				invalidateChanged(spec.InfoHash, &info, storageDir(backend, dir, spec.InfoHash), st.Files)
+			}
+		}
+		if st.MaxConns > 0 {
+			torrentMaxConns[spec.InfoHash] = st.MaxConns
+		}
+		if st.SeedRatio != 0 {
+			torrentSeedRatio[spec.InfoHash] = st.SeedRatio
+		}
+		if st.Selected != nil {
+			torrentFiles[spec.InfoHash] = st.Selected
+		}
+		if st.ManualPeers != nil {
+			torrentManualPeers[spec.InfoHash] = st.ManualPeers
+		}
+		if !st.LastVerified.IsZero() {
+			lastVerified[spec.InfoHash] = st.LastVerified
+		}
+		if st.NoLSD {
+			torrentNoLSD[spec.InfoHash] = true
+		}
+		torrentTotals[spec.InfoHash] = &transferTotals{
+			downloaded: st.Downloaded,
+			uploaded:   st.Uploaded,
+			active:     time.Duration(st.ActiveSecs) * time.Second,
+			seeding:    time.Duration(st.SeedingSecs) * time.Second,
+		}
+		t, err := addTorrent(spec, addOpts{Dir: st.Dir, Label: st.Label, Paused: !st.Want, Storage: st.Storage, WebSeeds: st.WebSeeds, Restored: true})
+		if err != nil {
+			logErrorf(nil, "restoring torrent %s: %s", st.DisplayName, err)
+			continue
+		}
+		torrentCompleted[t.InfoHash()] = st.Completed
+		torrentSeeded[t.InfoHash()] = st.Seeded
+		if !st.Added.IsZero() {
+			torrentAdded[t.InfoHash()] = st.Added
+		}
+		if !st.CompletedAt.IsZero() {
+			torrentCompletedAt[t.InfoHash()] = st.CompletedAt
+		}
+		restoredInfo[t.InfoHash()] = st.InfoBytes != nil
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/mjl-/duit"
+)
+
+// Settings is the user configuration, stored as JSON in settings.json in the application data directory.
+// Missing fields get their zero value, which always means "default" or "disabled".
+type Settings struct {
+	Hooks          map[string]string // Event name to shell command, see hookEvents.
+	HookTimeout    int               // In seconds, for hook commands. Default 60.
+	SeedRatio      float64           // Seeding goal, as ratio of uploaded data to torrent size. 0 means no goal.
+	Watch          []WatchFolder     // Directories to import .torrent and .magnet files from.
+	Feeds          []Feed            // RSS and Atom feeds to add torrents from.
+	VerifyInterval int               // In hours. If > 0, completed torrents are verified again after this interval, to detect bit rot.
+	Storage        string            // Default storage backend, see storageBackends. Default "file".
+	Network        NetworkSettings
+	StreamAddr     string // Address for the HTTP server that streams files, eg "localhost:8091". Empty disables streaming.
+	MetricsAddr    string // Address for the HTTP server with Prometheus metrics at /metrics, eg "localhost:9091". Empty disables metrics.
+
+	Blocklists        []string // Files or URLs with IP ranges to refuse, in P2P text or eMule ipfilter.dat format, optionally gzipped.
+	BlocklistInterval int      // In hours, for reloading blocklists from URLs. Default 24. Files are reloaded when they change.
+	BannedIPs         []string // IPs, CIDR ranges or "first-last" ranges, added to the blocklist.
+	BanThreshold      int      // Failed pieces blamed on a peer IP after which it is added to BannedIPs. Default 1, -1 disables.
+
+	Labels map[string]LabelDefaults // Label name to defaults for torrents with that label.
+
+	DHTBootstrapNodes []string // host:port of DHT nodes to bootstrap from, eg in isolated networks. Empty for the public bootstrap nodes.
+	DefaultTrackers   []string // Tracker URLs added to new torrents when they get their info, except to private torrents.
+
+	NoAddDialog bool // Add new torrents with the defaults, without showing the add dialog.
+
+	Columns []string // Columns in the torrent list, in order, see columns. Empty for the default.
+}
+
+var (
+	settings     Settings
+	settingsPath string
+)
+
+func appDataDir() string {
+	return duit.AppDataDir("duittorrent")
+}
+
+func loadSettings() {
+	buf, err := ioutil.ReadFile(settingsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf(nil, "reading settings: %s", err)
+		}
+		return
+	}
+	err = json.Unmarshal(buf, &settings)
+	check(err, "parsing settings")
+}
+
+func saveSettings() {
+	buf, err := json.MarshalIndent(settings, "", "\t")
+	if err == nil {
+		os.MkdirAll(path.Dir(settingsPath), 0777)
+		err = ioutil.WriteFile(settingsPath, buf, 0666)
+	}
+	if err != nil {
+		logErrorf(nil, "saving settings: %s", err)
+	}
+}
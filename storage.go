@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// Storage backends, selectable globally in Settings.Storage and per torrent.
+var storageBackends = []string{
+	"file",     // Files in the data directory.
+	"mmap",     // Same files, but memory-mapped.
+	"infohash", // Files in a directory named after the infohash, in the data directory.
+	"bolt",     // In bolt.db in the data directory.
+}
+
+var (
+	torrentStorage map[metainfo.Hash]string          // backend, if not the default
+	migrations     map[metainfo.Hash]*migration      // running storage migrations
+	boltStorages   = map[string]storage.ClientImpl{} // by directory, a bolt database can only be opened once
+)
+
+// migration is a running copy of the data of a torrent to another storage backend.
+type migration struct {
+	copied int64 // pieces, atomic
+	total  int
+}
+
+func migrationProgress(m *migration) int {
+	if m.total == 0 {
+		return 100
+	}
+	return int(100 * atomic.LoadInt64(&m.copied) / int64(m.total))
+}
+
+// torrentBackend returns the storage backend for the torrent.
+func torrentBackend(h metainfo.Hash) string {
+	if b := torrentStorage[h]; b != "" {
+		return b
+	}
+	if settings.Storage != "" {
+		return settings.Storage
+	}
+	return "file"
+}
+
+func checkBackend(backend string) error {
+	for _, b := range storageBackends {
+		if b == backend {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// storageDir returns the directory the files for a torrent are stored in, or the bolt database for backend bolt.
+func storageDir(backend, dir string, h metainfo.Hash) string {
+	switch backend {
+	case "infohash":
+		return filepath.Join(dir, h.HexString())
+	case "bolt":
+		return filepath.Join(dir, "bolt.db")
+	}
+	return dir
+}
+
+// dataPath returns the file or directory with the data of a torrent named name, or empty if the data is not in a separate file or directory, as with bolt storage.
+func dataPath(backend, dir, name string, h metainfo.Hash) string {
+	switch backend {
+	case "bolt":
+		return ""
+	case "infohash":
+		return storageDir(backend, dir, h)
+	}
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return ""
+	}
+	return filepath.Join(storageDir(backend, dir, h), name)
+}
+
+// infoHashStorage is file storage in a directory per infohash.
+// Unlike storage.NewFileByInfoHash, it uses our shared piece completion.
+type infoHashStorage struct {
+	dir string
+}
+
+func (s infoHashStorage) OpenTorrent(info *metainfo.Info, h metainfo.Hash) (storage.TorrentImpl, error) {
+	return fileStorage(storageDir("infohash", s.dir, h)).OpenTorrent(info, h)
+}
+
+func (s infoHashStorage) Close() error {
+	return nil
+}
+
+// sharedStorage is a storage that is used for multiple torrents, possibly also by multiple clients, and must stay open.
+type sharedStorage struct {
+	storage.ClientImpl
+}
+
+func (s sharedStorage) Close() error {
+	return nil
+}
+
+// newStorage returns a storage for backend, storing data in dir.
+func newStorage(backend, dir string) (storage.ClientImpl, error) {
+	switch backend {
+	case "file":
+		return fileStorage(dir), nil
+	case "mmap":
+		return storage.NewMMapWithCompletion(dir, pieceCompletion), nil
+	case "infohash":
+		return infoHashStorage{dir}, nil
+	case "bolt":
+		if s, ok := boltStorages[dir]; ok {
+			return s, nil
+		}
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+		bs, err := newBoltStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		s := sharedStorage{bs}
+		boltStorages[dir] = s
+		return s, nil
+	}
+	return nil, checkBackend(backend)
+}
+
+// newBoltStorage opens the bolt database in dir.
+// NewBoltDB panics on errors, eg when the database is locked by another process or cannot be read, we turn them into an error.
+func newBoltStorage(dir string) (s storage.ClientImpl, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("opening bolt database in %s: %v", dir, x)
+		}
+	}()
+	return storage.NewBoltDB(dir), nil
+}
+
+// startMigration moves the data of t to backend in directory ndir, in the background.
+// If ndir is empty, the data stays in the same directory.
+// The old files are removed after all pieces have been copied and verified, data in a bolt database is kept.
+// The torrent is dropped from the client while copying, and added again with the new storage when done.
+func startMigration(t *torrent.Torrent, backend, ndir string) {
+	h := t.InfoHash()
+	info := t.Info()
+	obackend := torrentBackend(h)
+	dir := torrentDir[h]
+	if dir == "" {
+		dir = defaultDataDir()
+	}
+	if ndir == "" {
+		ndir = dir
+	}
+	if info == nil || migrations[h] != nil || backend == obackend && ndir == dir {
+		return
+	}
+	ostorage, err := newStorage(obackend, dir)
+	if err == nil {
+		var nstorage storage.ClientImpl
+		nstorage, err = newStorage(backend, ndir)
+		if err == nil {
+			m := &migration{total: t.NumPieces()}
+			migrations[h] = m
+			mi := t.Metainfo()
+			complete := make([]bool, t.NumPieces())
+			for i := range complete {
+				complete[i] = t.PieceState(i).Complete
+			}
+			accountTransfer(t)
+			t.Drop()
+
+			// file and mmap have the same layout on disk, nothing to copy
+			same := storageDir(obackend, dir, h) == storageDir(backend, ndir, h) && obackend != "bolt" && backend != "bolt"
+			opath := dataPath(obackend, dir, info.Name, h)
+			npath := dataPath(backend, ndir, info.Name, h)
+			go func() {
+				var err error
+				if !same {
+					err = migrateData(m, info, h, ostorage, nstorage, complete)
+				}
+				var removeErr error
+				if err == nil && !same {
+					removeErr = removeOldData(opath, npath)
+				}
+				dui.Call <- func() {
+					migrationDone(h, mi, backend, ndir, err)
+					row := findRowHash(h)
+					if err != nil || same || row == nil {
+						return
+					}
+					t := row.Value.(*torrent.Torrent)
+					if opath == "" {
+						logWarnf(t, "old data in bolt database in %s kept", dir)
+					} else if removeErr != nil {
+						logErrorf(t, "removing old data: %s", removeErr)
+					} else {
+						logInfof(t, "removed old data %s", opath)
+					}
+				}
+			}()
+			return
+		}
+	}
+	logErrorf(t, "migrating storage: %s", err)
+}
+
+// migrateData copies all complete pieces from ostorage to nstorage, and verifies the copies.
+func migrateData(m *migration, info *metainfo.Info, h metainfo.Hash, ostorage, nstorage storage.ClientImpl, complete []bool) error {
+	ot, err := ostorage.OpenTorrent(info, h)
+	if err != nil {
+		return err
+	}
+	defer ot.Close()
+	nt, err := nstorage.OpenTorrent(info, h)
+	if err != nil {
+		return err
+	}
+	defer nt.Close()
+
+	buf := make([]byte, info.PieceLength)
+	for i := 0; i < info.NumPieces(); i++ {
+		atomic.AddInt64(&m.copied, 1)
+		if !complete[i] {
+			continue
+		}
+		p := info.Piece(i)
+		b := buf[:p.Length()]
+		if _, err := ot.Piece(p).ReadAt(b, 0); err != nil {
+			return fmt.Errorf("reading piece %d: %s", i, err)
+		}
+		np := nt.Piece(p)
+		if _, err := np.WriteAt(b, 0); err != nil {
+			return fmt.Errorf("writing piece %d: %s", i, err)
+		}
+		// storage may return io.EOF along with a full piece
+		if n, err := np.ReadAt(b, 0); n != len(b) {
+			return fmt.Errorf("reading back piece %d: %v", i, err)
+		}
+		if sum := sha1.Sum(b); !bytes.Equal(sum[:], p.Hash().Bytes()) {
+			return fmt.Errorf("piece %d differs after copying", i)
+		}
+		if err := np.MarkComplete(); err != nil {
+			return fmt.Errorf("marking piece %d complete: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// removeOldData removes the data at opath after a successful migration to npath.
+// Nothing is removed for bolt storage (empty opath), or if the new data is inside opath.
+func removeOldData(opath, npath string) error {
+	sep := string(filepath.Separator)
+	if opath == "" || opath == npath || strings.HasPrefix(npath+sep, opath+sep) {
+		return nil
+	}
+	return os.RemoveAll(opath)
+}
+
+// migrationDone adds the torrent again, with the new storage if the migration was successful.
+func migrationDone(h metainfo.Hash, mi metainfo.MetaInfo, backend, dir string, err error) {
+	delete(migrations, h)
+	row := findRowHash(h)
+	if row == nil {
+		return
+	}
+	spec := torrent.TorrentSpecFromMetaInfo(&mi)
+	if err != nil {
+		logErrorf(row.Value.(*torrent.Torrent), "migrating storage: %s", err)
+	} else {
+		logInfof(row.Value.(*torrent.Torrent), "migrated to storage %s in %s", backend, dir)
+		torrentStorage[h] = backend
+		if dir != defaultDataDir() || torrentDir[h] != "" {
+			torrentDir[h] = dir
+		}
+	}
+	if err := readdTorrent(row, spec); err != nil {
+		logErrorf(row.Value.(*torrent.Torrent), "adding after migration: %s", err)
+		return
+	}
+	if row.Selected {
+		t := row.Value.(*torrent.Torrent)
+		updateButtons(t)
+		updateDetails(t)
+	}
+	dui.MarkLayout(nil)
+	saveSession()
+}
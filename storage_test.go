@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+func TestMigrateData(t *testing.T) {
+	pieceCompletion = &completion{PieceCompletion: storage.NewMapPieceCompletion(), unknown: map[metainfo.PieceKey]bool{}}
+	dir, err := ioutil.TempDir("", "duittorrent-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	odir := filepath.Join(dir, "old")
+	ndir := filepath.Join(dir, "new")
+
+	info, data := webSeedTorrent()
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := metainfo.HashBytes(infoBytes)
+	ostorage, _ := newStorage("file", odir)
+	ot, err := ostorage.OpenTorrent(info, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := make([]bool, info.NumPieces())
+	for i := range complete {
+		p := info.Piece(i)
+		o := int64(i) * info.PieceLength
+		if _, err := ot.Piece(p).WriteAt(data[o:o+p.Length()], 0); err != nil {
+			t.Fatal(err)
+		}
+		complete[i] = true
+	}
+	ot.Close()
+
+	nstorage, _ := newStorage("infohash", ndir)
+	m := &migration{total: info.NumPieces()}
+	if err := migrateData(m, info, h, ostorage, nstorage, complete); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+	if migrationProgress(m) != 100 {
+		t.Fatalf("got progress %d, expected 100", migrationProgress(m))
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(ndir, h.HexString(), info.Name, "sub dir", "b"))
+	if err != nil || string(buf) != string(data[20000:]) {
+		t.Fatalf("migrated file: got err %v, data equal %v", err, string(buf) == string(data[20000:]))
+	}
+
+	opath := dataPath("file", odir, info.Name, h)
+	if err := removeOldData(opath, dataPath("infohash", ndir, info.Name, h)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(opath); !os.IsNotExist(err) {
+		t.Fatalf("old data not removed: %v", err)
+	}
+
+	// new data inside the old directory is kept
+	npath := filepath.Join(ndir, h.HexString(), info.Name)
+	if err := removeOldData(filepath.Join(ndir, h.HexString()), npath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(npath); err != nil {
+		t.Fatalf("new data removed: %v", err)
+	}
+}
+
+func TestNewBoltStorageLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "duittorrent-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newBoltStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// the database is locked, opening again times out, without panic
+	if _, err := newBoltStorage(dir); err == nil {
+		t.Fatalf("opening locked bolt database: no error")
+	}
+}
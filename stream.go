@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// Files are streamed over HTTP at /torrent/<infohash>/<file index>/<file name>.
+// A playlist with all files of a torrent is at /torrent/<infohash>.m3u.
+
+const streamReadahead = 16 * 1024 * 1024
+
+var (
+	streamBase     string            // base URL of the stream server, empty if not running
+	streamRequests chan streamLookup // torrent lookups from the HTTP server, handled by the main loop, which owns the clients
+)
+
+// streamLookup asks the main loop for the torrent with an infohash, nil is sent on c if there is none.
+type streamLookup struct {
+	hash metainfo.Hash
+	c    chan *torrent.Torrent
+}
+
+// lookupStream returns the torrent for h, from the main loop.
+func lookupStream(h metainfo.Hash) *torrent.Torrent {
+	row := findRowHash(h)
+	if row == nil {
+		return nil
+	}
+	return row.Value.(*torrent.Torrent)
+}
+
+// startStream starts the HTTP server for streaming, if enabled in the settings.
+func startStream() {
+	if settings.StreamAddr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", settings.StreamAddr)
+	check(err, "listen for streaming")
+	streamBase = "http://" + ln.Addr().String()
+	streamRequests = make(chan streamLookup)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/torrent/", serveStream)
+	go func() {
+		err := http.Serve(ln, mux)
+		logErrorf(nil, "stream server: %s", err)
+	}()
+}
+
+// streamURL returns the URL for streaming file index of t.
+func streamURL(t *torrent.Torrent, index int) string {
+	f := t.Files()[index]
+	return fmt.Sprintf("%s/torrent/%s/%d/%s", streamBase, t.InfoHash().HexString(), index, url.PathEscape(path.Base(f.Path())))
+}
+
+// playlistURL returns the URL of the M3U playlist for t.
+func playlistURL(t *torrent.Torrent) string {
+	return fmt.Sprintf("%s/torrent/%s.m3u", streamBase, t.InfoHash().HexString())
+}
+
+// ctxReader makes reads from a torrent reader stop when the HTTP request is done.
+type ctxReader struct {
+	torrent.Reader
+	ctx context.Context
+}
+
+func (r ctxReader) Read(buf []byte) (int, error) {
+	return r.ReadContext(r.ctx, buf)
+}
+
+func serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// <infohash>.m3u, or <infohash>/<index>/<name>
+	elems := strings.Split(strings.TrimPrefix(r.URL.Path, "/torrent/"), "/")
+	playlist := len(elems) == 1 && strings.HasSuffix(elems[0], ".m3u")
+	if !playlist && len(elems) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	var h metainfo.Hash
+	if err := h.FromHexString(strings.TrimSuffix(elems[0], ".m3u")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	c := make(chan *torrent.Torrent, 1)
+	select {
+	case streamRequests <- streamLookup{h, c}:
+	case <-r.Context().Done():
+		return
+	}
+	t := <-c
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	select {
+	case <-t.GotInfo():
+	case <-r.Context().Done():
+		return
+	}
+
+	files := t.Files()
+	if playlist {
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+		fmt.Fprintln(w, "#EXTM3U")
+		for i, f := range files {
+			fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", f.DisplayPath(), streamURL(t, i))
+		}
+		return
+	}
+
+	index, err := strconv.Atoi(elems[1])
+	if err != nil || index < 0 || index >= len(files) {
+		http.NotFound(w, r)
+		return
+	}
+	f := files[index]
+	reader := f.NewReader()
+	defer reader.Close()
+	reader.SetReadahead(streamReadahead)
+	reader.SetResponsive()
+	http.ServeContent(w, r, path.Base(f.Path()), time.Time{}, ctxReader{reader, r.Context()})
+}
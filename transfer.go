@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// transferTotals is the data transferred for a torrent over all sessions, and how long it was active.
+// The stats of the torrent library start at zero for each torrent object, so we add the differences.
+type transferTotals struct {
+	downloaded, uploaded int64         // data bytes
+	active, seeding      time.Duration // time wanted, and of that the time with all selected files complete
+
+	t             *torrent.Torrent // whose stats are counted up to read and written
+	read, written int64
+	last          time.Time // of previous accounting
+}
+
+// AllTime is the data transferred by all torrents over all sessions, including removed torrents.
+type AllTime struct {
+	Downloaded int64
+	Uploaded   int64
+}
+
+var (
+	torrentTotals map[metainfo.Hash]*transferTotals
+	allTime       AllTime
+	statusBar     *duit.Label
+)
+
+func allTimePath() string {
+	return appDataDir() + "/totals.json"
+}
+
+// totals returns the totals for h, creating them if needed.
+func totals(h metainfo.Hash) *transferTotals {
+	tt := torrentTotals[h]
+	if tt == nil {
+		tt = &transferTotals{}
+		torrentTotals[h] = tt
+	}
+	return tt
+}
+
+// uploaded returns the data sent to peers, over all sessions.
+func uploaded(t *torrent.Torrent) int64 {
+	return totals(t.InfoHash()).uploaded
+}
+
+// downloaded returns the data received from peers, over all sessions.
+func downloaded(t *torrent.Torrent) int64 {
+	return totals(t.InfoHash()).downloaded
+}
+
+// shareRatio returns the data uploaded over the size of t.
+// The info of t must be present.
+func shareRatio(t *torrent.Torrent) float64 {
+	if t.Length() == 0 {
+		return 0
+	}
+	return float64(uploaded(t)) / float64(t.Length())
+}
+
+// accountTransfer adds the data transferred and the time active since the previous call to the totals of t.
+// Must be called before dropping t.
+func accountTransfer(t *torrent.Torrent) {
+	h := t.InfoHash()
+	tt := totals(h)
+	if tt.t != t {
+		// new torrent object, its stats start at zero
+		tt.t = t
+		tt.read = 0
+		tt.written = 0
+	}
+	st := t.Stats()
+	read, written := st.BytesReadData.Int64(), st.BytesWrittenData.Int64()
+	tt.downloaded += read - tt.read
+	tt.uploaded += written - tt.written
+	allTime.Downloaded += read - tt.read
+	allTime.Uploaded += written - tt.written
+	tt.read = read
+	tt.written = written
+
+	// pieces from web seeds are written to storage directly, the library doesn't count them
+	for _, ws := range webSeeds[h] {
+		if ws.t != t {
+			continue
+		}
+		n := atomic.LoadInt64(&ws.read)
+		tt.downloaded += n - ws.accounted
+		allTime.Downloaded += n - ws.accounted
+		ws.accounted = n
+	}
+
+	now := time.Now()
+	if !tt.last.IsZero() && torrentWant[h] && migrations[h] == nil {
+		d := now.Sub(tt.last)
+		tt.active += d
+		if t.Info() != nil && bytesWantedMissing(t) == 0 {
+			tt.seeding += d
+		}
+	}
+	tt.last = now
+}
+
+// accountAll calls accountTransfer for all torrents that are not migrating.
+func accountAll() {
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		if migrations[t.InfoHash()] == nil {
+			accountTransfer(t)
+		}
+	}
+}
+
+// loadAllTime reads the all-time totals.
+// If there are none yet, they start as the sum of the totals of the torrents.
+func loadAllTime() {
+	buf, err := ioutil.ReadFile(allTimePath())
+	if err == nil {
+		err = json.Unmarshal(buf, &allTime)
+	}
+	if err == nil {
+		return
+	}
+	if !os.IsNotExist(err) {
+		logErrorf(nil, "reading totals: %s", err)
+	}
+	for _, tt := range torrentTotals {
+		allTime.Downloaded += tt.downloaded
+		allTime.Uploaded += tt.uploaded
+	}
+}
+
+func saveAllTime() {
+	buf, err := json.Marshal(allTime)
+	if err == nil {
+		os.MkdirAll(appDataDir(), 0777)
+		err = ioutil.WriteFile(allTimePath(), buf, 0666)
+	}
+	if err != nil {
+		logErrorf(nil, "saving totals: %s", err)
+	}
+}
+
+// formatDuration formats d in days, hours and minutes.
+func formatDuration(d time.Duration) string {
+	mins := int64(d / time.Minute)
+	switch {
+	case mins >= 24*60:
+		return fmt.Sprintf("%dd%02dh", mins/(24*60), mins/60%24)
+	case mins >= 60:
+		return fmt.Sprintf("%dh%02dm", mins/60, mins%60)
+	}
+	return fmt.Sprintf("%dm", mins)
+}
+
+// updateStatusBar shows the all-time totals.
+func updateStatusBar() {
+	ratio := ""
+	if allTime.Downloaded > 0 {
+		ratio = fmt.Sprintf(", ratio %.2f", float64(allTime.Uploaded)/float64(allTime.Downloaded))
+	}
+	text := fmt.Sprintf("all time: downloaded %s, uploaded %s%s", formatSize(allTime.Downloaded), formatSize(allTime.Uploaded), ratio)
+	if text != statusBar.Text {
+		statusBar.Text = text
+		if mainShown {
+			dui.MarkLayout(nil)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// verification is a running or finished check of the data of a torrent.
+type verification struct {
+	checked  int64 // pieces checked so far, atomic
+	total    int
+	running  bool
+	finished time.Time
+	bad      []int    // pieces that were complete before, but failed verification
+	badFiles []string // files containing bad pieces
+}
+
+var (
+	verifications map[metainfo.Hash]*verification
+	lastVerified  map[metainfo.Hash]time.Time // or when torrent info was received, for scheduled verification
+)
+
+func verifying(t *torrent.Torrent) bool {
+	v := verifications[t.InfoHash()]
+	return v != nil && v.running
+}
+
+// verifyProgress returns the percentage of pieces checked.
+func verifyProgress(v *verification) int {
+	if v.total == 0 {
+		return 100
+	}
+	return int(100 * atomic.LoadInt64(&v.checked) / int64(v.total))
+}
+
+// startVerify starts checking all data of t in the background.
+// Once done, the results are shown in the details.
+func startVerify(t *torrent.Torrent) {
+	if t.Info() == nil || verifying(t) {
+		return
+	}
+	n := t.NumPieces()
+	v := &verification{total: n, running: true}
+	verifications[t.InfoHash()] = v
+
+	complete := make([]bool, n)
+	for i := range complete {
+		complete[i] = t.PieceState(i).Complete
+	}
+	go func() {
+		bad := verifyPieces(t, v, complete)
+		dui.Call <- func() {
+			verifyDone(t, v, bad)
+		}
+	}()
+}
+
+// verifyPieces checks the data of t, returning the pieces that were complete but have bad data.
+// The torrent library doesn't check pieces it considers complete, so we hash those ourselves, and mark bad pieces as not complete in the storage.
+// Other pieces are checked by the library, which marks them complete if the data is good.
+func verifyPieces(t *torrent.Torrent, v *verification, complete []bool) []int {
+	info := t.Info()
+	var bad []int
+	buf := make([]byte, info.PieceLength)
+	for i := range complete {
+		p := t.Piece(i)
+		if !complete[i] {
+			p.VerifyData()
+			atomic.AddInt64(&v.checked, 1)
+			continue
+		}
+		mp := info.Piece(i)
+		b := buf[:mp.Length()]
+		n, err := p.Storage().ReadAt(b, 0)
+		if n == len(b) {
+			// storage can return io.EOF with all data read
+			err = nil
+		}
+		if err != nil || metainfo.Hash(sha1.Sum(b)) != mp.Hash() {
+			bad = append(bad, i)
+			if err := p.Storage().MarkNotComplete(); err != nil {
+				logErrorf(t, "marking piece %d as not complete: %s", i, err)
+			}
+		}
+		atomic.AddInt64(&v.checked, 1)
+	}
+	return bad
+}
+
+func verifyDone(t *torrent.Torrent, v *verification, bad []int) {
+	h := t.InfoHash()
+	if row := findRow(t); row != nil && len(bad) > 0 && migrations[h] == nil {
+		// the library still has the bad pieces as complete, adding the torrent again makes it read their state from storage, and download them again
+		mi := t.Metainfo()
+		spec := &torrent.TorrentSpec{
+			InfoHash:    h,
+			Trackers:    mi.AnnounceList,
+			InfoBytes:   mi.InfoBytes,
+			DisplayName: t.Name(),
+		}
+		accountTransfer(t)
+		t.Drop()
+		delete(torrentStats, h)
+		if err := readdTorrent(row, spec); err != nil {
+			logErrorf(t, "adding after verify: %s", err)
+		} else {
+			t = row.Value.(*torrent.Torrent)
+		}
+	}
+
+	v.running = false
+	v.finished = time.Now()
+	v.bad = bad
+	v.badFiles = badFiles(t, bad)
+	lastVerified[t.InfoHash()] = v.finished
+	if len(bad) > 0 {
+		err := fmt.Errorf("verify: %d bad pieces, in files %v", len(bad), v.badFiles)
+		logErrorf(t, "%s", err)
+	} else {
+		logInfof(t, "verify: all data ok")
+	}
+	if row := findRow(t); row != nil {
+		updateRow(row, false)
+		if row.Selected {
+			updateButtons(t)
+			updateDetails(t)
+		}
+	}
+	dui.MarkLayout(nil)
+}
+
+// badFiles returns the paths of the files that overlap with the pieces.
+func badFiles(t *torrent.Torrent, pieces []int) []string {
+	var r []string
+	pieceLength := t.Info().PieceLength
+	for _, f := range t.Files() {
+		for _, p := range pieces {
+			start := int64(p) * pieceLength
+			if start < f.Offset()+f.Length() && f.Offset() < start+pieceLength {
+				r = append(r, f.Path())
+				break
+			}
+		}
+	}
+	return r
+}
+
+// checkScheduledVerify starts verification of a seeding torrent that hasn't been verified for settings.VerifyInterval.
+// Only one torrent is verified at a time.
+func checkScheduledVerify() {
+	if settings.VerifyInterval <= 0 {
+		return
+	}
+	for _, v := range verifications {
+		if v.running {
+			return
+		}
+	}
+	interval := time.Duration(settings.VerifyInterval) * time.Hour
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		if t.Info() == nil || migrations[h] != nil || t.BytesMissing() != 0 {
+			continue
+		}
+		if tm, ok := lastVerified[h]; ok && time.Since(tm) >= interval {
+			startVerify(t)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestVerifyPieces(t *testing.T) {
+	cleanup := newTestClient(t)
+	defer cleanup()
+
+	// the data of the torrent, complete in the data directory of the client
+	info, data := webSeedTorrent()
+	writeTorrentData(t, config.DataDir, info, data)
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: metainfo.HashBytes(infoBytes), InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tor.GotInfo()
+	tor.VerifyData()
+	for deadline := time.Now().Add(5 * time.Second); tor.BytesMissing() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("data not complete after adding")
+		}
+	}
+
+	complete := func() []bool {
+		l := make([]bool, tor.NumPieces())
+		for i := range l {
+			l[i] = tor.PieceState(i).Complete
+		}
+		return l
+	}
+	v := &verification{total: tor.NumPieces()}
+	if bad := verifyPieces(tor, v, complete()); len(bad) != 0 || v.checked != int64(v.total) {
+		t.Fatalf("good data: got bad %v, checked %d", bad, v.checked)
+	}
+
+	// corrupt a byte of piece 1, in the second file
+	p := filepath.Join(config.DataDir, info.Name, "sub dir", "b")
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{^data[20000+100]}, 100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	v = &verification{total: tor.NumPieces()}
+	bad := verifyPieces(tor, v, complete())
+	if !reflect.DeepEqual(bad, []int{1}) {
+		t.Fatalf("corrupt data: got bad %v, expected [1]", bad)
+	}
+	if tor.Piece(1).Storage().Completion().Complete {
+		t.Fatalf("bad piece still complete in storage")
+	}
+}
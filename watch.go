@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// WatchFolder is a directory that is checked for new .torrent and .magnet files.
+// A .magnet file holds a single magnet URI.
+// Added files are renamed with ".added" appended, or moved to Archive if set.
+// Files that cannot be parsed are renamed with ".invalid" appended.
+type WatchFolder struct {
+	Dir         string
+	Archive     string // Directory to move added files to. Optional.
+	Paused      bool   // Add torrents paused.
+	DownloadDir string // Directory to store data in. Optional.
+	Label       string // Label for added torrents. Optional.
+}
+
+const (
+	watchSettle   = 5 * time.Second // files modified more recently may still be written
+	watchAttempts = 3               // parse attempts before a file is renamed to .invalid
+)
+
+var (
+	watchSkip     = map[string]bool{} // files we could not rename after processing
+	watchFailures = map[string]int{}  // failed parse attempts per file
+)
+
+// checkWatchFolders adds torrents for new files in all watch folders.
+// Called periodically from the main loop.
+func checkWatchFolders() {
+	for _, wf := range settings.Watch {
+		files, err := ioutil.ReadDir(wf.Dir)
+		if err != nil {
+			logErrorf(nil, "watch folder: %s", err)
+			continue
+		}
+		for _, fi := range files {
+			name := fi.Name()
+			if !fi.Mode().IsRegular() || !(strings.HasSuffix(name, ".torrent") || strings.HasSuffix(name, ".magnet")) {
+				continue
+			}
+			p := filepath.Join(wf.Dir, name)
+			if !watchSkip[p] && time.Since(fi.ModTime()) >= watchSettle {
+				watchAdd(wf, p)
+			}
+		}
+	}
+}
+
+func watchAdd(wf WatchFolder, p string) {
+	spec, ws, err := watchSpec(p)
+	if err != nil {
+		// the file could still be in the process of being written
+		watchFailures[p]++
+		if watchFailures[p] < watchAttempts {
+			return
+		}
+		delete(watchFailures, p)
+		logErrorf(nil, "watch folder: %s: %s", p, err)
+		runHook("error", nil, fmt.Errorf("watch folder: %s: %s", p, err))
+		watchRename(p, p+".invalid")
+		return
+	}
+	delete(watchFailures, p)
+	_, err = addTorrent(spec, addOpts{
+		Dir:      wf.DownloadDir,
+		Label:    wf.Label,
+		Paused:   wf.Paused,
+		WebSeeds: ws,
+	})
+	if err != nil {
+		logErrorf(nil, "watch folder: adding %s: %s", p, err)
+		runHook("error", nil, fmt.Errorf("watch folder: adding %s: %s", p, err))
+		watchRename(p, p+".invalid")
+		return
+	}
+	if wf.Archive != "" {
+		watchRename(p, filepath.Join(wf.Archive, filepath.Base(p)))
+	} else {
+		watchRename(p, p+".added")
+	}
+}
+
+// watchSpec returns the spec and web seeds of a .magnet or .torrent file.
+func watchSpec(p string) (*torrent.TorrentSpec, []string, error) {
+	if strings.HasSuffix(p, ".magnet") {
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		uri := strings.TrimSpace(string(buf))
+		spec, err := torrent.TorrentSpecFromMagnetURI(uri)
+		return spec, magnetWebSeeds(uri), err
+	}
+	mi, err := metainfo.LoadFromFile(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := mi.UnmarshalInfo(); err != nil {
+		return nil, nil, err
+	}
+	return torrent.TorrentSpecFromMetaInfo(mi), mi.UrlList, nil
+}
+
+// watchRename moves a processed file out of the way, so it is not picked up again.
+// An existing file at dst is not overwritten, a number is added to the name instead.
+// If renaming fails, eg to another file system, the file is copied and removed.
+// If that fails too, we remember the file and skip it until the next start.
+func watchRename(src, dst string) {
+	dst = uniquePath(dst)
+	err := os.Rename(src, dst)
+	if err != nil {
+		err = moveFile(src, dst)
+	}
+	if err != nil {
+		logErrorf(nil, "watch folder: %s", err)
+		watchSkip[src] = true
+	}
+}
+
+// uniquePath returns p, or if it exists, p with "-1", "-2", etc inserted before the extension.
+func uniquePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	np := p
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(np); os.IsNotExist(err) {
+			return np
+		}
+		np = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+// moveFile copies src to dst, which must not exist, and removes src.
+func moveFile(src, dst string) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(df, sf)
+	if err == nil {
+		err = df.Close()
+	} else {
+		df.Close()
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("copying %s to %s: %s", src, dst, err)
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"9fans.net/go/draw"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/mjl-/duit"
+)
+
+// Web seeds (BEP 19) are HTTP servers with the files of a torrent, from the url-list of the metainfo, "ws" parameters of magnet links, or added by hand.
+// The torrent library doesn't support them. We fetch whole pieces with range requests, check their hash, write them to the storage of the torrent and let the library verify them.
+
+const (
+	webSeedMaxBad = 3 // bad pieces after which a web seed is no longer used
+	webSeedRetry  = 30 * time.Second
+	webSeedIdle   = 5 * time.Second // between looking for pieces to fetch
+)
+
+// errNoRanges is returned for a web seed that ignores range requests. Fetching every piece would transfer the files from their start each time, so such web seeds are no longer used.
+var errNoRanges = errors.New("server does not support range requests")
+
+// webSeed fetches pieces from a web seed, for a single torrent object.
+type webSeed struct {
+	url    string
+	t      *torrent.Torrent
+	claims *pieceClaims
+
+	read      int64 // data of good pieces, accessed atomically
+	lastRead  int64 // as of previous tick, for rate
+	rate      int64 // bytes per second, main loop only
+	accounted int64 // of read, added to the transfer totals, main loop only
+
+	sync.Mutex
+	pieces int // good pieces
+	bad    int
+	state  string
+}
+
+// pieceClaims are the pieces being fetched by the web seeds of a torrent, so they don't fetch the same piece.
+type pieceClaims struct {
+	sync.Mutex
+	m map[int]bool
+}
+
+var (
+	torrentWebSeeds map[metainfo.Hash][]string   // URLs
+	webSeeds        map[metainfo.Hash][]*webSeed // running, for the current torrent objects
+	webSeedHTTP     = &http.Client{Timeout: 5 * time.Minute}
+)
+
+// magnetWebSeeds returns the web seeds in the "ws" parameters of a magnet link.
+func magnetWebSeeds(uri string) []string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil
+	}
+	return u.Query()["ws"]
+}
+
+// addWebSeeds adds the URLs not yet known to the web seeds of h.
+func addWebSeeds(h metainfo.Hash, urls []string) {
+	for _, s := range urls {
+		known := false
+		for _, o := range torrentWebSeeds[h] {
+			known = known || o == s
+		}
+		if !known {
+			torrentWebSeeds[h] = append(torrentWebSeeds[h], s)
+		}
+	}
+}
+
+// checkWebSeedURL returns an error if s cannot be used as web seed.
+func checkWebSeedURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q, only http and https", u.Scheme)
+	}
+	return nil
+}
+
+// updateWebSeeds starts fetching from web seeds of torrents with info, and calculates their rates.
+// Fetchers stop when their torrent is dropped. Called each tick.
+func updateWebSeeds() {
+	for _, row := range torrentRows {
+		t := row.Value.(*torrent.Torrent)
+		h := t.InfoHash()
+		urls := torrentWebSeeds[h]
+		if len(urls) == 0 || t.Info() == nil || migrations[h] != nil {
+			continue
+		}
+		l := webSeeds[h]
+		if len(l) > 0 && l[0].t != t {
+			// torrent was added again
+			l = nil
+		}
+		claims := &pieceClaims{m: map[int]bool{}}
+		if len(l) > 0 {
+			claims = l[0].claims
+		}
+		for _, u := range urls[len(l):] {
+			ws := &webSeed{url: u, t: t, claims: claims, state: "starting"}
+			l = append(l, ws)
+			go ws.run()
+		}
+		for _, ws := range l {
+			n := atomic.LoadInt64(&ws.read)
+			ws.rate = (n - ws.lastRead) * int64(time.Second) / int64(tickInterval)
+			ws.lastRead = n
+		}
+		webSeeds[h] = l
+	}
+}
+
+func (ws *webSeed) setState(format string, args ...interface{}) {
+	ws.Lock()
+	ws.state = fmt.Sprintf(format, args...)
+	ws.Unlock()
+}
+
+// status returns the good pieces and the state, for showing.
+func (ws *webSeed) status() (int, string) {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.pieces, ws.state
+}
+
+func (ws *webSeed) run() {
+	if err := checkWebSeedURL(ws.url); err != nil {
+		ws.setState("%s", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ws.t.Closed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	wait := func(d time.Duration) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	info := ws.t.Info()
+	for {
+		i := ws.pick()
+		if i < 0 {
+			ws.setState("idle")
+			if !wait(webSeedIdle) {
+				return
+			}
+			continue
+		}
+		ws.setState("piece %d", i)
+		err := ws.fetch(ctx, info, i)
+		ws.claims.Lock()
+		delete(ws.claims.m, i)
+		ws.claims.Unlock()
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logWarnf(ws.t, "web seed %s: %s", ws.url, err)
+		if err == errNoRanges {
+			ws.setState("disabled, %s", err)
+			return
+		}
+		ws.Lock()
+		bad := ws.bad
+		ws.Unlock()
+		if bad >= webSeedMaxBad {
+			ws.setState("disabled after %d bad pieces", bad)
+			return
+		}
+		ws.setState("%s", err)
+		if !wait(webSeedRetry) {
+			return
+		}
+	}
+}
+
+// pick claims a wanted piece that is not complete, preferring pieces that peers haven't started on.
+// Returns -1 if there is none.
+func (ws *webSeed) pick() int {
+	ws.claims.Lock()
+	defer ws.claims.Unlock()
+	partial := -1
+	i := 0
+	for _, r := range ws.t.PieceStateRuns() {
+		if r.Priority == torrent.PiecePriorityNone || r.Complete || r.Checking {
+			i += r.Length
+			continue
+		}
+		for j := i; j < i+r.Length; j++ {
+			if ws.claims.m[j] {
+				continue
+			}
+			if !r.Partial {
+				ws.claims.m[j] = true
+				return j
+			}
+			if partial < 0 {
+				partial = j
+			}
+		}
+		i += r.Length
+	}
+	if partial >= 0 {
+		ws.claims.m[partial] = true
+	}
+	return partial
+}
+
+// fetch downloads piece i, checks its hash and writes it to the storage of the torrent.
+func (ws *webSeed) fetch(ctx context.Context, info *metainfo.Info, i int) error {
+	p := info.Piece(i)
+	buf := make([]byte, 0, p.Length())
+	for _, fr := range fileRanges(info, int64(i)*info.PieceLength, p.Length()) {
+		b, err := webSeedGet(ctx, webSeedFileURL(ws.url, info, fr.file), fr.offset, fr.length)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b...)
+	}
+	if metainfo.Hash(sha1.Sum(buf)) != p.Hash() {
+		ws.Lock()
+		ws.bad++
+		ws.Unlock()
+		return fmt.Errorf("bad data for piece %d", i)
+	}
+	tp := ws.t.Piece(i)
+	if _, err := tp.Storage().WriteAt(buf, 0); err != nil {
+		return fmt.Errorf("writing piece %d: %s", i, err)
+	}
+	tp.VerifyData()
+	if !ws.t.PieceState(i).Complete {
+		return fmt.Errorf("piece %d not complete after writing", i)
+	}
+	atomic.AddInt64(&ws.read, int64(len(buf)))
+	ws.Lock()
+	ws.pieces++
+	ws.Unlock()
+	return nil
+}
+
+// fileRange is a part of a file.
+type fileRange struct {
+	file           int
+	offset, length int64
+}
+
+// fileRanges returns the parts of the files of info that hold the torrent data at offset, of length bytes.
+func fileRanges(info *metainfo.Info, offset, length int64) []fileRange {
+	var l []fileRange
+	var start int64
+	for i, f := range info.UpvertedFiles() {
+		end := start + f.Length
+		if offset < end && offset+length > start {
+			o, e := offset, offset+length
+			if o < start {
+				o = start
+			}
+			if e > end {
+				e = end
+			}
+			l = append(l, fileRange{i, o - start, e - o})
+		}
+		start = end
+	}
+	return l
+}
+
+// webSeedFileURL returns the URL of a file of the torrent at web seed base, as specified by BEP 19.
+func webSeedFileURL(base string, info *metainfo.Info, file int) string {
+	if len(info.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(info.Name)
+		}
+		return base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	elems := append([]string{info.Name}, info.Files[file].Path...)
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return base + strings.Join(elems, "/")
+}
+
+// webSeedGet fetches length bytes at offset of the file at u.
+// If the server ignores the range, only data at the start of the file can be used, otherwise errNoRanges is returned.
+func webSeedGet(ctx context.Context, u string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := webSeedHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// server ignored the range, the data we need is at the start only for the first piece of the file
+		if offset > 0 {
+			return nil, errNoRanges
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, fmt.Errorf("%s: %s", u, err)
+	}
+	return buf, nil
+}
+
+// webSeedField returns the UI for adding a web seed to t by hand.
+func webSeedField(t *torrent.Torrent) duit.UI {
+	status := &duit.Label{}
+	field := &duit.Field{Placeholder: "web seed url..."}
+	add := func() (e duit.Event) {
+		dui.MarkLayout(nil)
+		s := strings.TrimSpace(field.Text)
+		if err := checkWebSeedURL(s); err != nil {
+			status.Text = err.Error()
+			return
+		}
+		addWebSeeds(t.InfoHash(), []string{s})
+		saveSession()
+		logInfof(t, "added web seed %s", s)
+		field.Text = ""
+		status.Text = "added"
+		return
+	}
+	field.Keys = func(k rune, m draw.Mouse) (e duit.Event) {
+		if k == '\n' {
+			e = add()
+			e.Consumed = true
+		}
+		return
+	}
+	return &duit.Box{
+		Margin: image.Pt(6, 4),
+		Kids: duit.NewKids(
+			&duit.Box{Width: 300, Kids: duit.NewKids(field)},
+			&duit.Button{Text: "add web seed", Click: add},
+			status,
+		),
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"golang.org/x/time/rate"
+)
+
+// newTestClient sets config and client to a client without network use except for listening on localhost, storing data in a new temporary directory.
+func newTestClient(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "duittorrent-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = torrent.NewDefaultClientConfig()
+	config.DataDir = dir
+	config.NoDHT = true
+	config.DisableTrackers = true
+	config.DisableIPv6 = true
+	config.ListenHost = func(string) string { return "127.0.0.1" }
+	config.ListenPort = 0
+	config.DownloadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
+	config.UploadRateLimiter = rate.NewLimiter(rate.Inf, 16*1024)
+	client, err = torrent.NewClient(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		client.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// webSeedTorrent returns the info and data of a torrent with two files, of 3 pieces.
+func webSeedTorrent() (*metainfo.Info, []byte) {
+	data := make([]byte, 40*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	info := &metainfo.Info{
+		Name:        "dir",
+		PieceLength: 16 * 1024,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a"}, Length: 20000},
+			{Path: []string{"sub dir", "b"}, Length: int64(len(data)) - 20000},
+		},
+	}
+	for o := 0; o < len(data); o += int(info.PieceLength) {
+		e := o + int(info.PieceLength)
+		if e > len(data) {
+			e = len(data)
+		}
+		h := sha1.Sum(data[o:e])
+		info.Pieces = append(info.Pieces, h[:]...)
+	}
+	return info, data
+}
+
+// writeTorrentData writes the files of info with data to dir, like file storage does.
+func writeTorrentData(t *testing.T, dir string, info *metainfo.Info, data []byte) {
+	var o int64
+	for _, f := range info.Files {
+		p := filepath.Join(append([]string{dir, info.Name}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data[o:o+f.Length], 0644); err != nil {
+			t.Fatal(err)
+		}
+		o += f.Length
+	}
+}
+
+func TestFileRanges(t *testing.T) {
+	info, _ := webSeedTorrent()
+	expect := [][]fileRange{
+		{{0, 0, 16 * 1024}},
+		{{0, 16 * 1024, 20000 - 16*1024}, {1, 0, 32*1024 - 20000}},
+		{{1, 32*1024 - 20000, 8 * 1024}},
+	}
+	for i, x := range expect {
+		p := info.Piece(i)
+		l := fileRanges(info, int64(i)*info.PieceLength, p.Length())
+		if !reflect.DeepEqual(l, x) {
+			t.Errorf("piece %d: got %v, expected %v", i, l, x)
+		}
+	}
+}
+
+func TestWebSeedFileURL(t *testing.T) {
+	info, _ := webSeedTorrent()
+	single := &metainfo.Info{Name: "a b.iso", Length: 1}
+	for _, c := range []struct {
+		base string
+		info *metainfo.Info
+		file int
+		url  string
+	}{
+		{"http://example.com/files/", info, 1, "http://example.com/files/dir/sub%20dir/b"},
+		{"http://example.com/files", info, 0, "http://example.com/files/dir/a"},
+		{"http://example.com/files/", single, 0, "http://example.com/files/a%20b.iso"},
+		{"http://example.com/other.iso", single, 0, "http://example.com/other.iso"},
+	} {
+		if u := webSeedFileURL(c.base, c.info, c.file); u != c.url {
+			t.Errorf("webSeedFileURL %s, file %d: got %s, expected %s", c.base, c.file, u, c.url)
+		}
+	}
+}
+
+func TestWebSeedGet(t *testing.T) {
+	_, data := webSeedTorrent()
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a", time.Time{}, bytes.NewReader(data))
+	}))
+	defer ranges.Close()
+	noRanges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer noRanges.Close()
+
+	ctx := context.Background()
+	buf, err := webSeedGet(ctx, ranges.URL, 100, 50)
+	if err != nil || string(buf) != string(data[100:150]) {
+		t.Fatalf("range: got err %v, data equal %v", err, string(buf) == string(data[100:150]))
+	}
+	buf, err = webSeedGet(ctx, noRanges.URL, 0, 50)
+	if err != nil || string(buf) != string(data[:50]) {
+		t.Fatalf("no ranges at start: got err %v, data equal %v", err, string(buf) == string(data[:50]))
+	}
+	if _, err := webSeedGet(ctx, noRanges.URL, 100, 50); err != errNoRanges {
+		t.Fatalf("no ranges after start: got err %v, expected %v", err, errNoRanges)
+	}
+	if _, err := webSeedGet(ctx, ranges.URL, int64(len(data)), 1); err == nil {
+		t.Fatalf("range past end: no error")
+	}
+}
+
+func TestWebSeedFetch(t *testing.T) {
+	cleanup := newTestClient(t)
+	defer cleanup()
+
+	info, data := webSeedTorrent()
+	srcDir, err := ioutil.TempDir("", "duittorrent-webseed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	var o int64
+	for _, f := range info.Files {
+		p := filepath.Join(append([]string{srcDir, info.Name}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data[o:o+f.Length], 0644); err != nil {
+			t.Fatal(err)
+		}
+		o += f.Length
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(srcDir)))
+	defer srv.Close()
+
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tor, _, err := client.AddTorrentSpec(&torrent.TorrentSpec{InfoHash: metainfo.HashBytes(infoBytes), InfoBytes: infoBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tor.GotInfo()
+
+	ws := &webSeed{url: srv.URL, t: tor, claims: &pieceClaims{m: map[int]bool{}}}
+	ctx := context.Background()
+	for i := 0; i < info.NumPieces(); i++ {
+		if err := ws.fetch(ctx, tor.Info(), i); err != nil {
+			t.Fatalf("fetch piece %d: %s", i, err)
+		}
+		if !tor.PieceState(i).Complete {
+			t.Fatalf("piece %d not complete", i)
+		}
+	}
+	if ws.read != int64(len(data)) || ws.pieces != info.NumPieces() || ws.bad != 0 {
+		t.Fatalf("got read %d, pieces %d, bad %d", ws.read, ws.pieces, ws.bad)
+	}
+	if tor.BytesMissing() != 0 {
+		t.Fatalf("missing %d bytes", tor.BytesMissing())
+	}
+
+	// corrupt data is not written
+	if err := ioutil.WriteFile(filepath.Join(srcDir, info.Name, "a"), make([]byte, 20000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.fetch(ctx, tor.Info(), 0); err == nil || ws.bad != 1 {
+		t.Fatalf("corrupt piece: got err %v, bad %d", err, ws.bad)
+	}
+}